@@ -0,0 +1,226 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Cache holds serialized responses. It is only ever an optimization: a cache
+// that fails behaves like an empty one and handlers fall back to the store.
+type Cache interface {
+	// Get returns the value under key, or false on a miss
+	Get(key string) ([]byte, bool)
+	// Generation is taken before reading what a value is built from
+	Generation() uint64
+	// Set stores value under key, tagged with what it was built from, unless
+	// one of the tags was invalidated after generation was taken
+	Set(key string, value []byte, ttl time.Duration, tags []string, generation uint64)
+	// Invalidate drops every key carrying one of tags
+	Invalidate(tags ...string)
+}
+
+// cacheTTL bounds how long a response is cached even if nothing invalidates it
+const cacheTTL = 10 * time.Minute
+
+// Cache tags. Every entry carries cacheTagAll, plus the packages it shows
+// and, for list pages, the package columns its filters and sort read.
+const (
+	cacheTagAll = "all"
+	// cacheTagMembers is invalidated when a package is created or deleted
+	cacheTagMembers = "members"
+)
+
+func packageTag(name string) string { return "package:" + name }
+
+func listFieldTag(field string) string { return "list:" + field }
+
+// cachePut stores a JSON response under key with the given tags. generation
+// is cache.Generation() from before the store was read, so a response built
+// from rows a write has changed since is not cached.
+func cachePut(key string, v interface{}, tags []string, generation uint64) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	cache.Set(key, value, cacheTTL, append(tags, cacheTagAll), generation)
+}
+
+// cacheGet decodes a cached JSON response into v, reporting a miss when
+// nothing usable is cached
+func cacheGet(key string, v interface{}) bool {
+	value, ok := cache.Get(key)
+	return ok && json.Unmarshal(value, v) == nil
+}
+
+// invalidatePackage drops the cached responses showing the package, and the
+// list pages whose filters or sort read one of the changed columns
+func invalidatePackage(name string, changedFields ...string) {
+	tags := []string{packageTag(name)}
+	for _, field := range changedFields {
+		tags = append(tags, listFieldTag(field))
+	}
+	cache.Invalidate(tags...)
+}
+
+// changedListFields returns the columns a list query can filter or sort on
+// that differ between current and desired
+func changedListFields(current, desired Package) []string {
+	var fields []string
+	if current.Stars != desired.Stars {
+		fields = append(fields, "stars")
+	}
+	if current.License != desired.License {
+		fields = append(fields, "license")
+	}
+	if current.Supports != desired.Supports {
+		fields = append(fields, "supports")
+	}
+	if current.LastModified != desired.LastModified {
+		fields = append(fields, "last_modified")
+	}
+	added, removed := diffSet(featureNames(current), featureNames(desired))
+	if len(added) > 0 || len(removed) > 0 {
+		fields = append(fields, "features")
+	}
+	return fields
+}
+
+func featureNames(pkg Package) []string {
+	names := make([]string, 0, len(pkg.Features))
+	for name := range pkg.Features {
+		names = append(names, name)
+	}
+	return names
+}
+
+// cache is the backend selected by CACHE_DRIVER
+var cache Cache
+
+// openCache opens the backend for driver: redis, lru or none. size bounds the
+// number of entries of the lru backend.
+func openCache(driver string, size int) (Cache, error) {
+	switch driver {
+	case "redis":
+		return newRedisCache(), nil
+	case "lru":
+		return newLRUCache(size), nil
+	case "none":
+		return noopCache{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported cache driver %q, expected redis, lru or none", driver)
+	}
+}
+
+// noopCache never holds anything
+type noopCache struct{}
+
+func (noopCache) Get(key string) ([]byte, bool)                                                     { return nil, false }
+func (noopCache) Generation() uint64                                                                { return 0 }
+func (noopCache) Set(key string, value []byte, ttl time.Duration, tags []string, generation uint64) {}
+func (noopCache) Invalidate(tags ...string)                                                         {}
+
+// lruCache is an in-process cache evicting the least recently used entry
+// once it holds size entries
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // front is the most recently used
+	entries map[string]*list.Element
+	tagged  map[string]map[string]bool // tag to keys
+
+	// generation counts invalidations, invalidated holds the generation that
+	// last invalidated each tag. Tags are package names and columns, so it
+	// stays as large as the index.
+	generation  uint64
+	invalidated map[string]uint64
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+	tags    []string
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{
+		size:        size,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+		tagged:      make(map[string]map[string]bool),
+		invalidated: make(map[string]uint64),
+	}
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *lruCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration, tags []string, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		if c.invalidated[tag] > generation {
+			return
+		}
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: time.Now().Add(ttl), tags: tags})
+	for _, tag := range tags {
+		if c.tagged[tag] == nil {
+			c.tagged[tag] = make(map[string]bool)
+		}
+		c.tagged[tag][key] = true
+	}
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lruCache) Invalidate(tags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, tag := range tags {
+		c.invalidated[tag] = c.generation
+		for key := range c.tagged[tag] {
+			c.remove(c.entries[key])
+		}
+	}
+}
+
+// remove drops an entry and its tags; the caller holds mu
+func (c *lruCache) remove(elem *list.Element) {
+	entry := elem.Value.(*lruEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key)
+	for _, tag := range entry.tags {
+		delete(c.tagged[tag], entry.key)
+		if len(c.tagged[tag]) == 0 {
+			delete(c.tagged, tag)
+		}
+	}
+}
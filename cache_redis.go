@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ctx = context.Background()
+
+// redisRetryInterval is how long the cache is bypassed after Redis failed
+const redisRetryInterval = 5 * time.Second
+
+// redisCache keeps the cache in Redis. While Redis is unreachable every
+// request is a miss, and invalidations are remembered and replayed before the
+// cache is used again, so no page from before the outage survives it.
+type redisCache struct {
+	client *redis.Client
+
+	mu      sync.Mutex
+	retryAt time.Time
+	down    bool
+	pending map[string]bool // tags to invalidate once Redis is back
+}
+
+// redisTagPrefix prefixes the sets holding the keys of each tag
+const redisTagPrefix = "tag:"
+
+// redisTagWindow is how long keys are added to one set of a tag. Each window
+// has its own set, which expires once every key it holds has, so the sets of
+// tags on every entry like all stay as large as one window's keys.
+const redisTagWindow = cacheTTL
+
+// tagWindow numbers the window t falls in
+func tagWindow(t time.Time) int64 {
+	return t.UnixNano() / int64(redisTagWindow)
+}
+
+func tagSet(tag string, window int64) string {
+	return redisTagPrefix + tag + ":" + strconv.FormatInt(window, 10)
+}
+
+// redisGenerationKey counts invalidations. The key of each tag under
+// redisGenerationPrefix holds the count of its last invalidation, for as long
+// as a value built before it could still be set.
+const (
+	redisGenerationKey    = "generation"
+	redisGenerationPrefix = "generation:"
+)
+
+// invalidateScript deletes the keys in the tag sets KEYS[1] and KEYS[2] with
+// the sets, and records the invalidation under KEYS[4] for ARGV[1]
+// milliseconds. As a script no Set can add to a set between the read and the
+// delete.
+var invalidateScript = redis.NewScript(`
+local keys = redis.call('SUNION', KEYS[1], KEYS[2])
+for i = 1, #keys, 1000 do
+	redis.call('DEL', unpack(keys, i, math.min(i + 999, #keys)))
+end
+redis.call('DEL', KEYS[1], KEYS[2])
+local generation = redis.call('INCR', KEYS[3])
+redis.call('SET', KEYS[4], generation, 'PX', ARGV[1])
+return generation
+`)
+
+// errStaleValue stops a Set whose value was built before an invalidation
+var errStaleValue = errors.New("value built before an invalidation of its tags")
+
+func initRedis() *redis.Client {
+	// Read Redis host and port from environment variables
+	redisHost := os.Getenv("REDIS_HOST")
+	if redisHost == "" {
+		redisHost = "localhost" // Fallback to localhost if not set
+	}
+
+	redisPort := os.Getenv("REDIS_PORT")
+	if redisPort == "" {
+		redisPort = "6379" // Fallback to default Redis port if not set
+	}
+
+	// Construct Redis address
+	redisAddr := redisHost + ":" + redisPort
+
+	// Initialize Redis client. Short timeouts and no retries keep a slow or
+	// missing Redis from holding up requests.
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:         redisAddr,
+		DialTimeout:  500 * time.Millisecond,
+		ReadTimeout:  500 * time.Millisecond,
+		WriteTimeout: 500 * time.Millisecond,
+		MaxRetries:   -1,
+	})
+	return redisClient
+}
+
+func newRedisCache() *redisCache {
+	c := &redisCache{client: initRedis(), pending: make(map[string]bool)}
+	if err := c.client.Ping(ctx).Err(); err != nil {
+		c.fail(err)
+	}
+	return c
+}
+
+// fail bypasses Redis for a while; the caller holds mu unless it is the constructor
+func (c *redisCache) fail(err error) {
+	if !c.down {
+		log.Printf("Redis unavailable, serving without cache: %v", err)
+	}
+	c.down = true
+	c.retryAt = time.Now().Add(redisRetryInterval)
+}
+
+// available reports whether Redis may be used, replaying missed
+// invalidations first
+func (c *redisCache) available() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down && time.Now().Before(c.retryAt) {
+		return false
+	}
+	for tag := range c.pending {
+		if err := c.invalidate(tag); err != nil {
+			c.fail(err)
+			return false
+		}
+		delete(c.pending, tag)
+	}
+	if c.down {
+		log.Printf("Redis available again")
+		c.down = false
+	}
+	return true
+}
+
+func (c *redisCache) Get(key string) ([]byte, bool) {
+	if !c.available() {
+		return nil, false
+	}
+	value, err := c.client.Get(ctx, key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			c.mu.Lock()
+			c.fail(err)
+			c.mu.Unlock()
+		}
+		return nil, false
+	}
+	return value, true
+}
+
+func (c *redisCache) Generation() uint64 {
+	if !c.available() {
+		return 0
+	}
+	generation, err := c.client.Get(ctx, redisGenerationKey).Uint64()
+	if err != nil && err != redis.Nil {
+		c.mu.Lock()
+		c.fail(err)
+		c.mu.Unlock()
+	}
+	return generation
+}
+
+// Set also adds key to the current set of each tag. The set expires one ttl
+// after its window ends, so it outlives every key it holds but not longer.
+// The generation keys of the tags are watched, an invalidation between
+// checking them and the write makes it fail.
+func (c *redisCache) Set(key string, value []byte, ttl time.Duration, tags []string, generation uint64) {
+	if !c.available() {
+		return
+	}
+	// Invalidate only looks back one window
+	ttl = min(ttl, redisTagWindow)
+	window := tagWindow(time.Now())
+	expireAt := time.Unix(0, (window+1)*int64(redisTagWindow)).Add(ttl)
+	generationKeys := make([]string, len(tags))
+	for i, tag := range tags {
+		generationKeys[i] = redisGenerationPrefix + tag
+	}
+	err := c.client.Watch(ctx, func(tx *redis.Tx) error {
+		invalidated, err := tx.MGet(ctx, generationKeys...).Result()
+		if err != nil {
+			return err
+		}
+		for _, v := range invalidated {
+			if s, ok := v.(string); ok {
+				if n, err := strconv.ParseUint(s, 10, 64); err == nil && n > generation {
+					return errStaleValue
+				}
+			}
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, value, ttl)
+			for _, tag := range tags {
+				pipe.SAdd(ctx, tagSet(tag, window), key)
+				pipe.ExpireAt(ctx, tagSet(tag, window), expireAt)
+			}
+			return nil
+		})
+		return err
+	}, generationKeys...)
+	if err != nil && err != errStaleValue && err != redis.TxFailedErr {
+		c.mu.Lock()
+		c.fail(err)
+		c.mu.Unlock()
+	}
+}
+
+func (c *redisCache) Invalidate(tags ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, tag := range tags {
+		if c.down && time.Now().Before(c.retryAt) {
+			c.pending[tag] = true
+			continue
+		}
+		if err := c.invalidate(tag); err != nil {
+			c.pending[tag] = true
+			c.fail(err)
+		}
+	}
+}
+
+// invalidate deletes the keys of tag along with the sets of the current and
+// the previous window; keys in the sets of older windows have expired
+func (c *redisCache) invalidate(tag string) error {
+	window := tagWindow(time.Now())
+	keys := []string{tagSet(tag, window), tagSet(tag, window-1), redisGenerationKey, redisGenerationPrefix + tag}
+	return invalidateScript.Run(ctx, c.client, keys, redisTagWindow.Milliseconds()).Err()
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUCacheSkipsStaleSet(t *testing.T) {
+	c := newLRUCache(10)
+	generation := c.Generation()
+	c.Invalidate(packageTag("zlib"))
+
+	c.Set("zlib", []byte("stale"), time.Minute, []string{packageTag("zlib")}, generation)
+	if _, ok := c.Get("zlib"); ok {
+		t.Error("a value read before an invalidation of its tag was cached")
+	}
+
+	// Values of other tags, or read after the invalidation, are kept
+	c.Set("curl", []byte("curl"), time.Minute, []string{packageTag("curl")}, generation)
+	c.Set("zlib", []byte("zlib"), time.Minute, []string{packageTag("zlib")}, c.Generation())
+	for _, key := range []string{"curl", "zlib"} {
+		if value, ok := c.Get(key); !ok || string(value) != key {
+			t.Errorf("%s: %q, %v", key, value, ok)
+		}
+	}
+}
@@ -2,4 +2,10 @@ module github.com/frate-packages/new_indexer
 
 go 1.23.1
 
-require github.com/mattn/go-sqlite3 v1.14.24 // indirect
+require (
+	github.com/frate-packages/package-server v0.0.0
+	github.com/mattn/go-sqlite3 v1.14.24
+)
+
+// The schema migrations are shared with the server in the parent directory
+replace github.com/frate-packages/package-server => ../
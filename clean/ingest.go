@@ -0,0 +1,442 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/frate-packages/package-server/schema"
+)
+
+// IngestReport lists what a run changed in the database
+type IngestReport struct {
+	Added       []string        `json:"added"`
+	Removed     []string        `json:"removed"`
+	Changed     []PackageChange `json:"changed"`
+	Kept        []PackageChange `json:"kept"` // created or edited through the API, with what the source would change
+	Unchanged   int             `json:"unchanged"`
+	TagFailures []TagFailure    `json:"tag_failures"`
+}
+
+// PackageChange holds the field-level differences of one package
+type PackageChange struct {
+	Name    string        `json:"name"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// FieldChange is either a scalar change (Old, New) or a set change (Added, Removed).
+// Fields of a feature are named "features.<name>.<field>".
+type FieldChange struct {
+	Field   string            `json:"field"`
+	Old     interface{}       `json:"old,omitempty"`
+	New     interface{}       `json:"new,omitempty"`
+	Added   []json.RawMessage `json:"added,omitempty"`
+	Removed []json.RawMessage `json:"removed,omitempty"`
+}
+
+// dbConn is satisfied by both *sql.DB and *sql.Tx
+type dbConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// dedupeRows removes the duplicate edges left behind by runs that only inserted
+func dedupeRows(conn dbConn) error {
+	tables := map[string]string{
+		"dependencies":         "package_name, dependency_name, platform, host, features, default_features",
+		"features":             "package_name, feature_name",
+		"feature_dependencies": "package_name, feature_name, dependency_name, platform, host, features, default_features",
+		"feature_requirements": "package_name, feature_name, required_package, required_feature, platform",
+		"default_features":     "package_name, feature_name, platform",
+	}
+	for table, columns := range tables {
+		_, err := conn.Exec("DELETE FROM " + table + " WHERE rowid NOT IN (SELECT MIN(rowid) FROM " + table + " GROUP BY " + columns + ")")
+		if err != nil {
+			return fmt.Errorf("error removing duplicate rows from %s: %v", table, err)
+		}
+	}
+	return nil
+}
+
+// loadStoredPackages reads every package currently in the database, one query per table
+func loadStoredPackages(conn dbConn) (map[string]*Package, error) {
+	packages := make(map[string]*Package)
+	feature := func(pkgName, featName string) *Feature {
+		pkg := packages[pkgName]
+		if pkg == nil {
+			return nil
+		}
+		feat := pkg.Features[featName]
+		return &feat
+	}
+
+	err := eachRow(conn, `SELECT name, COALESCE(version, ''), COALESCE(port_version, 0), COALESCE(description, ''), COALESCE(homepage, ''), COALESCE(git_url, ''),
+		COALESCE(repository_source, ''), COALESCE(license, ''), COALESCE(supports, ''), COALESCE(stars, 0), COALESCE(last_modified, ''), COALESCE(cmake_target, '') FROM packages`,
+		func(scan func(...interface{}) error) error {
+			pkg := &Package{Features: make(map[string]Feature)}
+			if err := scan(&pkg.Name, &pkg.Version, &pkg.PortVersion, &pkg.Description, &pkg.Homepage, &pkg.GitURL, &pkg.RepositorySource, &pkg.License, &pkg.Supports, &pkg.Stars, &pkg.LastModified, &pkg.CMakeTarget); err != nil {
+				return err
+			}
+			packages[pkg.Name] = pkg
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(conn, "SELECT package_name, "+schema.DependencyColumns+" FROM dependencies ORDER BY rowid",
+		func(scan func(...interface{}) error) error {
+			var name string
+			dep, err := schema.ScanDependency(scan, &name)
+			if err == nil && packages[name] != nil {
+				packages[name].Dependencies = append(packages[name].Dependencies, Dependency(dep))
+			}
+			return err
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(conn, "SELECT package_name, feature_name, COALESCE(description, ''), COALESCE(supports, '') FROM features",
+		func(scan func(...interface{}) error) error {
+			var name, featName string
+			var feat Feature
+			if err := scan(&name, &featName, &feat.Description, &feat.Supports); err != nil {
+				return err
+			}
+			if packages[name] != nil {
+				packages[name].Features[featName] = feat
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(conn, "SELECT package_name, feature_name, "+schema.DependencyColumns+" FROM feature_dependencies ORDER BY rowid",
+		func(scan func(...interface{}) error) error {
+			var name, featName string
+			dep, err := schema.ScanDependency(scan, &name, &featName)
+			if err != nil {
+				return err
+			}
+			if feat := feature(name, featName); feat != nil {
+				feat.Dependencies = append(feat.Dependencies, Dependency(dep))
+				packages[name].Features[featName] = *feat
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(conn, "SELECT package_name, feature_name, required_package, required_feature, COALESCE(platform, '') FROM feature_requirements ORDER BY rowid",
+		func(scan func(...interface{}) error) error {
+			var name, featName string
+			var req FeatureRequirement
+			if err := scan(&name, &featName, &req.Package, &req.Feature, &req.Platform); err != nil {
+				return err
+			}
+			if req.Package == name {
+				req.Package = ""
+			}
+			if feat := feature(name, featName); feat != nil {
+				feat.RequiredFeatures = append(feat.RequiredFeatures, req)
+				packages[name].Features[featName] = *feat
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(conn, "SELECT package_name, feature_name, COALESCE(platform, '') FROM default_features ORDER BY rowid",
+		func(scan func(...interface{}) error) error {
+			var name string
+			var feat DefaultFeature
+			if err := scan(&name, &feat.Name, &feat.Platform); err != nil {
+				return err
+			}
+			if packages[name] != nil {
+				packages[name].DefaultFeatures = append(packages[name].DefaultFeatures, feat)
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// loadAPIPackages returns the packages created or edited through the API
+func loadAPIPackages(conn dbConn) (map[string]bool, error) {
+	packages := make(map[string]bool)
+	err := eachRow(conn, "SELECT name FROM packages WHERE source = 'api'", func(scan func(...interface{}) error) error {
+		var name string
+		err := scan(&name)
+		packages[name] = true
+		return err
+	})
+	return packages, err
+}
+
+// loadAPIRepositories reads the git_url set through the API of each package
+// from the database at path. A missing database, or one from before
+// repository_source existed, has none.
+func loadAPIRepositories(path string) (map[string]string, error) {
+	repositories := make(map[string]string)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return repositories, nil
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database: %v", err)
+	}
+	defer db.Close()
+
+	var hasColumn bool
+	err = db.QueryRow("SELECT COUNT(*) > 0 FROM pragma_table_info('packages') WHERE name = 'repository_source'").Scan(&hasColumn)
+	if err != nil || !hasColumn {
+		return repositories, err
+	}
+	err = eachRow(db, "SELECT name, COALESCE(git_url, '') FROM packages WHERE repository_source = 'api'", func(scan func(...interface{}) error) error {
+		var name, gitURL string
+		err := scan(&name, &gitURL)
+		repositories[name] = gitURL
+		return err
+	})
+	return repositories, err
+}
+
+// eachRow runs the query and hands every row to fn
+func eachRow(conn dbConn, query string, fn func(scan func(...interface{}) error) error) error {
+	rows, err := conn.Query(query)
+	if err != nil {
+		return fmt.Errorf("error reading stored packages: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows.Scan); err != nil {
+			return fmt.Errorf("error reading stored packages: %v", err)
+		}
+	}
+	return rows.Err()
+}
+
+// jsonKey identifies a value by its JSON encoding, which is also how the report shows it
+func jsonKey(v interface{}) string {
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
+
+// diffByKey returns the entries of desired missing from current, and the entries of current missing from desired
+func diffByKey[T any](current, desired []T) (added, removed []T) {
+	return diffBy(current, desired, func(v T) string { return jsonKey(v) })
+}
+
+// diffDependencies compares edges the way the database matches them
+func diffDependencies(current, desired []Dependency) (added, removed []Dependency) {
+	return diffBy(current, desired, func(dep Dependency) string { return schema.Dependency(dep).Key() })
+}
+
+func diffBy[T any](current, desired []T, key func(T) string) (added, removed []T) {
+	have := make(map[string]bool, len(current))
+	for _, v := range current {
+		have[key(v)] = true
+	}
+	want := make(map[string]bool, len(desired))
+	for _, v := range desired {
+		if !have[key(v)] && !want[key(v)] {
+			added = append(added, v)
+		}
+		want[key(v)] = true
+	}
+	for _, v := range current {
+		if !want[key(v)] {
+			removed = append(removed, v)
+			want[key(v)] = true
+		}
+	}
+	return added, removed
+}
+
+// setChange reports a set difference, or nothing when both sides are empty
+func setChange[T any](field string, added, removed []T) []FieldChange {
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	change := FieldChange{Field: field}
+	for _, v := range added {
+		change.Added = append(change.Added, json.RawMessage(jsonKey(v)))
+	}
+	for _, v := range removed {
+		change.Removed = append(change.Removed, json.RawMessage(jsonKey(v)))
+	}
+	return []FieldChange{change}
+}
+
+// sortedFeatureNames returns the feature names of both packages in order
+func sortedFeatureNames(a, b map[string]Feature) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, features := range []map[string]Feature{a, b} {
+		for name := range features {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// diffPackage lists every field of pkg that differs from the stored package
+func diffPackage(stored, pkg *Package) []FieldChange {
+	var changes []FieldChange
+	scalar := func(field string, old, new interface{}) {
+		if old != new {
+			changes = append(changes, FieldChange{Field: field, Old: old, New: new})
+		}
+	}
+	scalar("version", stored.Version, pkg.Version)
+	scalar("port_version", stored.PortVersion, pkg.PortVersion)
+	scalar("description", stored.Description, pkg.Description)
+	scalar("homepage", stored.Homepage, pkg.Homepage)
+	scalar("git_url", stored.GitURL, pkg.GitURL)
+	scalar("repository_source", stored.RepositorySource, pkg.RepositorySource)
+	scalar("license", stored.License, pkg.License)
+	scalar("supports", stored.Supports, pkg.Supports)
+	scalar("stars", stored.Stars, pkg.Stars)
+	scalar("last_modified", stored.LastModified, pkg.LastModified)
+	scalar("cmake_target", stored.CMakeTarget, pkg.CMakeTarget)
+
+	added, removed := diffDependencies(stored.Dependencies, pkg.Dependencies)
+	changes = append(changes, setChange("dependencies", added, removed)...)
+	addedDefaults, removedDefaults := diffByKey(stored.DefaultFeatures, pkg.DefaultFeatures)
+	changes = append(changes, setChange("default_features", addedDefaults, removedDefaults)...)
+
+	var addedFeatures, removedFeatures []string
+	for _, name := range sortedFeatureNames(stored.Features, pkg.Features) {
+		old, inStored := stored.Features[name]
+		feat, inPkg := pkg.Features[name]
+		switch {
+		case !inStored:
+			addedFeatures = append(addedFeatures, name)
+		case !inPkg:
+			removedFeatures = append(removedFeatures, name)
+		default:
+			prefix := "features." + name + "."
+			scalar(prefix+"description", old.Description, feat.Description)
+			scalar(prefix+"supports", old.Supports, feat.Supports)
+			added, removed := diffDependencies(old.Dependencies, feat.Dependencies)
+			changes = append(changes, setChange(prefix+"dependencies", added, removed)...)
+			addedReqs, removedReqs := diffByKey(old.RequiredFeatures, feat.RequiredFeatures)
+			changes = append(changes, setChange(prefix+"required_features", addedReqs, removedReqs)...)
+		}
+	}
+	changes = append(changes, setChange("features", addedFeatures, removedFeatures)...)
+	return changes
+}
+
+// insertPackage writes a package that is not in the database yet
+func insertPackage(conn dbConn, pkg *Package) error {
+	_, err := conn.Exec(
+		`INSERT INTO packages (name, version, port_version, description, homepage, git_url, repository_source, license, supports, stars, last_modified, cmake_target)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		pkg.Name, pkg.Version, pkg.PortVersion, pkg.Description, pkg.Homepage, pkg.GitURL, pkg.RepositorySource, pkg.License, pkg.Supports, pkg.Stars, pkg.LastModified, pkg.CMakeTarget,
+	)
+	if err != nil {
+		return fmt.Errorf("error inserting package %s: %v", pkg.Name, err)
+	}
+	return updatePackageEdges(conn, &Package{Name: pkg.Name}, pkg)
+}
+
+// updatePackage applies the differences between the stored package and pkg
+func updatePackage(conn dbConn, stored, pkg *Package) error {
+	_, err := conn.Exec(
+		`UPDATE packages SET version = ?, port_version = ?, description = ?, homepage = ?, git_url = ?, repository_source = ?, license = ?, supports = ?, stars = ?, last_modified = ?, cmake_target = ?
+		 WHERE name = ?`,
+		pkg.Version, pkg.PortVersion, pkg.Description, pkg.Homepage, pkg.GitURL, pkg.RepositorySource, pkg.License, pkg.Supports, pkg.Stars, pkg.LastModified, pkg.CMakeTarget, pkg.Name,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating package %s: %v", pkg.Name, err)
+	}
+	return updatePackageEdges(conn, stored, pkg)
+}
+
+// updatePackageEdges inserts and deletes only the rows that differ
+func updatePackageEdges(conn dbConn, stored, pkg *Package) error {
+	return schema.UpdateEdges(conn, pkg.Name, stored.edges(), pkg.edges())
+}
+
+// edges converts the rows of pkg outside of packages for schema.UpdateEdges
+func (pkg *Package) edges() schema.Edges {
+	edges := schema.Edges{Features: make(map[string]schema.Feature, len(pkg.Features))}
+	for _, dep := range pkg.Dependencies {
+		edges.Dependencies = append(edges.Dependencies, schema.Dependency(dep))
+	}
+	for _, feature := range pkg.DefaultFeatures {
+		edges.DefaultFeatures = append(edges.DefaultFeatures, schema.DefaultFeature(feature))
+	}
+	for name, feat := range pkg.Features {
+		stored := schema.Feature{Description: feat.Description, Supports: feat.Supports}
+		for _, dep := range feat.Dependencies {
+			stored.Dependencies = append(stored.Dependencies, schema.Dependency(dep))
+		}
+		for _, req := range feat.RequiredFeatures {
+			stored.RequiredFeatures = append(stored.RequiredFeatures, schema.FeatureRequirement(req))
+		}
+		edges.Features[name] = stored
+	}
+	return edges
+}
+
+// deleteStoredPackage removes a package that vanished from the source, with all its rows
+func deleteStoredPackage(conn dbConn, name string) error {
+	for _, table := range []string{"dependencies", "features", "feature_dependencies", "feature_requirements", "default_features", "cmake_targets", "package_versions"} {
+		if _, err := conn.Exec("DELETE FROM "+table+" WHERE package_name = ?", name); err != nil {
+			return fmt.Errorf("error deleting %s of package %s: %v", table, name, err)
+		}
+	}
+	if _, err := conn.Exec("DELETE FROM packages WHERE name = ?", name); err != nil {
+		return fmt.Errorf("error deleting package %s: %v", name, err)
+	}
+	return nil
+}
+
+// printReport writes a short human readable summary of the report
+func printReport(report IngestReport) {
+	fmt.Printf("Ingest: %d added, %d removed, %d changed, %d kept, %d unchanged\n", len(report.Added), len(report.Removed), len(report.Changed), len(report.Kept), report.Unchanged)
+	for _, name := range report.Added {
+		fmt.Printf("  + %s\n", name)
+	}
+	for _, name := range report.Removed {
+		fmt.Printf("  - %s\n", name)
+	}
+	for _, change := range report.Changed {
+		fields := make([]string, len(change.Changes))
+		for i, c := range change.Changes {
+			fields[i] = c.Field
+		}
+		fmt.Printf("  ~ %s: %s\n", change.Name, strings.Join(fields, ", "))
+	}
+	for _, change := range report.Kept {
+		fields := make([]string, len(change.Changes))
+		for i, c := range change.Changes {
+			fields[i] = c.Field
+		}
+		if len(fields) == 0 {
+			fmt.Printf("  = %s: edited through the API, kept\n", change.Name)
+		} else {
+			fmt.Printf("  = %s: edited through the API, kept over the source changes to %s\n", change.Name, strings.Join(fields, ", "))
+		}
+	}
+	for _, f := range report.TagFailures {
+		fmt.Printf("  ! %s: tags unavailable after %d attempts: %s\n", f.Name, f.Attempts, f.Error)
+	}
+}
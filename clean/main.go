@@ -4,36 +4,178 @@ import (
 	"database/sql"
 
 	"encoding/json"
+	"flag"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"os"
-	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/frate-packages/package-server/schema"
+	"github.com/frate-packages/package-server/semver"
 )
 
 // Feature struct representing each feature
 type Feature struct {
-	Description      string   `json:"description"`
-	RequiredFeatures []string `json:"required_features,omitempty"`
-	Dependencies     []string `json:"dependencies,omitempty"`
+	Description      string               `json:"description"`
+	RequiredFeatures []FeatureRequirement `json:"required_features,omitempty"`
+	Dependencies     []Dependency         `json:"dependencies,omitempty"`
+	Supports         string               `json:"supports,omitempty"`
+}
+
+// FeatureRequirement is a feature that must be enabled along with another one,
+// in the same package when Package is empty
+type FeatureRequirement struct {
+	Package  string `json:"package,omitempty"`
+	Feature  string `json:"feature"`
+	Platform string `json:"platform,omitempty"`
+}
+
+type featureRequirementObject FeatureRequirement
+
+func (r FeatureRequirement) MarshalJSON() ([]byte, error) {
+	if r.Platform != "" {
+		return json.Marshal(featureRequirementObject(r))
+	}
+	if r.Package == "" {
+		return json.Marshal(r.Feature)
+	}
+	return json.Marshal(r.Package + "[" + r.Feature + "]")
+}
+
+// Dependency is an edge to another package with its vcpkg qualifiers. Edges
+// without qualifiers are encoded as a plain name string.
+type Dependency struct {
+	Name            string   `json:"name"`
+	Platform        string   `json:"platform,omitempty"`
+	Host            bool     `json:"host,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	DefaultFeatures *bool    `json:"default-features,omitempty"`
+}
+
+type dependencyObject Dependency
+
+func (d Dependency) MarshalJSON() ([]byte, error) {
+	if d.Platform == "" && !d.Host && len(d.Features) == 0 && d.DefaultFeatures == nil {
+		return json.Marshal(d.Name)
+	}
+	return json.Marshal(dependencyObject(d))
+}
+
+func (d *Dependency) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*d = Dependency{Name: name}
+		return nil
+	}
+	var obj dependencyObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*d = Dependency(obj)
+	return nil
+}
+
+// DefaultFeature is a feature enabled by default, optionally only on some platforms
+type DefaultFeature struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+}
+
+type defaultFeatureObject DefaultFeature
+
+func (f DefaultFeature) MarshalJSON() ([]byte, error) {
+	if f.Platform == "" {
+		return json.Marshal(f.Name)
+	}
+	return json.Marshal(defaultFeatureObject(f))
+}
+
+func (f *DefaultFeature) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*f = DefaultFeature{Name: name}
+		return nil
+	}
+	var obj defaultFeatureObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*f = DefaultFeature(obj)
+	return nil
+}
+
+// parseDependency reads a vcpkg dependency, either a name or an object
+func parseDependency(raw interface{}) (Dependency, bool) {
+	switch dep := raw.(type) {
+	case string:
+		return Dependency{Name: dep}, true
+	case map[string]interface{}:
+		name, ok := dep["name"].(string)
+		if !ok {
+			return Dependency{}, false
+		}
+		d := Dependency{Name: name}
+		d.Platform, _ = dep["platform"].(string)
+		d.Host, _ = dep["host"].(bool)
+		if defaults, ok := dep["default-features"].(bool); ok {
+			d.DefaultFeatures = &defaults
+		}
+		if features, ok := dep["features"].([]interface{}); ok {
+			for _, feature := range features {
+				switch f := feature.(type) {
+				case string:
+					d.Features = append(d.Features, f)
+				case map[string]interface{}:
+					// Platform-qualified features are kept by name
+					if name, ok := f["name"].(string); ok {
+						d.Features = append(d.Features, name)
+					}
+				}
+			}
+		}
+		return d, true
+	default:
+		return Dependency{}, false
+	}
 }
 
 // Package struct representing the package structure
 type Package struct {
-	Name         string             `json:"name"`
-	Version      string             `json:"version"`
-	Tag          string             `json:"tag"`
-	Versions     []string           `json:"versions"`
-	Description  string             `json:"description"`
-	GitURL       string             `json:"gitURL"`
-	License      string             `json:"license"`
-	Supports     string             `json:"supports,omitempty"`
-	Stars        int                `json:"stars"`
-	LastModified string             `json:"last_modified"`
-	Dependencies []string           `json:"dependencies"`
-	Features     map[string]Feature `json:"features,omitempty"`
-	CMakeTarget  string             `json:"cmake_target,omitempty"`
+	Name             string             `json:"name"`
+	Version          string             `json:"version"`
+	PortVersion      int                `json:"port_version"`
+	ManifestVersion  string             `json:"manifest_version"` // the version the manifest describes
+	Tag              string             `json:"tag"`
+	Versions         []string           `json:"versions"`
+	Description      string             `json:"description"`
+	Homepage         string             `json:"homepage"`
+	GitURL           string             `json:"gitURL"`
+	RepositorySource string             `json:"repository_source,omitempty"`
+	License          string             `json:"license"`
+	Supports         string             `json:"supports,omitempty"`
+	Stars            int                `json:"stars"`
+	LastModified     string             `json:"last_modified"`
+	Dependencies     []Dependency       `json:"dependencies"`
+	Features         map[string]Feature `json:"features,omitempty"`
+	DefaultFeatures  []DefaultFeature   `json:"default_features,omitempty"`
+	CMakeTarget      string             `json:"cmake_target,omitempty"`
+	CMakeTargets     []CMakeTarget      `json:"cmake_targets,omitempty"`
+	Refs             []GitRef           `json:"refs,omitempty"`
+	TagError         string             `json:"tag_error,omitempty"`
+}
+
+// CMakeTarget is an imported target of a package, or of one of its features
+// when Feature is set, together with the find_package call providing it.
+// Module marks packages found through a Find module rather than a config file.
+type CMakeTarget struct {
+	Feature     string `json:"feature,omitempty"`
+	FindPackage string `json:"find_package"`
+	Component   string `json:"component,omitempty"`
+	Target      string `json:"target"`
+	Module      bool   `json:"module,omitempty"`
 }
 
 // Root struct representing the entire JSON structure
@@ -45,16 +187,19 @@ type Root struct {
 
 // RawPackage struct to handle mixed types in `Dependencies`, `Description`, and `Features`
 type RawPackage struct {
-	Name         string          `json:"Name"`
-	Version      string          `json:"Version"`
-	Description  json.RawMessage `json:"Description"`
-	GitURL       string          `json:"homepage"`
-	License      string          `json:"License"`
-	Supports     string          `json:"Supports,omitempty"`
-	Stars        int             `json:"Stars"`
-	LastModified string          `json:"LastModified"`
-	Dependencies json.RawMessage `json:"Dependencies"`
-	Features     json.RawMessage `json:"Features,omitempty"`
+	Name            string           `json:"Name"`
+	Version         string           `json:"Version"`
+	PortVersion     int              `json:"Port-Version"`
+	Description     json.RawMessage  `json:"Description"`
+	Homepage        string           `json:"homepage"`
+	License         string           `json:"License"`
+	Supports        string           `json:"Supports,omitempty"`
+	Stars           int              `json:"Stars"`
+	LastModified    string           `json:"LastModified"`
+	Dependencies    json.RawMessage  `json:"Dependencies"`
+	Features        json.RawMessage  `json:"Features,omitempty"`
+	DefaultFeatures []DefaultFeature `json:"Default-Features,omitempty"`
+	PortDir         string           `json:"-"`
 }
 
 var versionRegexes = []*regexp.Regexp{
@@ -67,26 +212,14 @@ var versionRegexes = []*regexp.Regexp{
 	regexp.MustCompile(`^(master|latest|stable|main)$`), // Specific keywords
 }
 
-// Parse remote git tags
-func parseRemoteLsTags(output string) []string {
-	lines := strings.Split(output, "\n")
-	var tags []string
-
-	for _, line := range lines {
-		if strings.Contains(line, "refs/tags/") || strings.Contains(line, "refs/heads/") {
-			parts := strings.Split(line, "/")
-			tag := parts[len(parts)-1]
-
-			if validateVersionName(tag) {
-				tags = append(tags, tag)
-			}
-		}
-	}
-	return tags
-}
+// prereleaseTag accepts prerelease tags, which versionRegexes alone rejects
+var prereleaseTag = regexp.MustCompile(`(?i)^[A-Za-z_-]*v?\d+(?:[._]\d+)+[-.]?(?:alpha|beta|pre|preview|rc)[.-]?\d*$`)
 
 // Validate if a version matches known version patterns
 func validateVersionName(version string) bool {
+	if prereleaseTag.MatchString(version) {
+		return true
+	}
 	for _, regex := range versionRegexes {
 		if regex.MatchString(version) {
 			return true
@@ -95,91 +228,68 @@ func validateVersionName(version string) bool {
 	return false
 }
 
-// Function to extract remote versions from git, returns empty version if GitURL is invalid or inaccessible
-func getRemoteVersions(packageInfo *Package) error {
-	if packageInfo.GitURL != "" {
-		cmd := exec.Command("git", "ls-remote", packageInfo.GitURL)
-
-		// Log the URL for debugging purposes
-		fmt.Printf("Fetching tags for repository: %s\n", packageInfo.GitURL)
-
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			// Log the error, but return an empty array instead of failing
-			fmt.Printf("Error running git ls-remote for %s: %s. Returning empty versions.\n", packageInfo.GitURL, string(out))
-			packageInfo.Versions = []string{} // Return empty versions
-			return nil                        // No error returned, continue processing
-		}
-
-		tags := parseRemoteLsTags(string(out))
-		if len(tags) > 0 {
-			// Set the latest tag as the version
-			packageInfo.Version = tags[len(tags)-1]
-			packageInfo.Versions = tags
-		} else {
-			// If no tags are found, return empty versions
-			fmt.Printf("No valid git tags found for %s. Returning empty versions.\n", packageInfo.GitURL)
-			packageInfo.Versions = []string{}
-		}
-		return nil
+// loadCMakeTargets reads the package to CMake target mapping file. A missing
+// file is not an error, packages then keep their name as cmake_target.
+func loadCMakeTargets(path string) (map[string][]CMakeTarget, error) {
+	mapping := make(map[string][]CMakeTarget)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return mapping, nil
+	} else if err != nil {
+		return nil, err
 	}
-	// No Git URL provided, return empty versions
-	fmt.Printf("No git URL provided for %s. Returning empty versions.\n", packageInfo.Name)
-	packageInfo.Versions = []string{}
-	return nil
-}
-
-// Function to map known dependency names to CMake target names
-func MapDependencyToCMakeTarget(depName string) string {
-	cmakeTargetMap := map[string]string{
-		"boost-asio":   "Boost::asio",
-		"boost-system": "Boost::system",
-		"openssl":      "OpenSSL::SSL",
-		// Add more mappings as needed...
+	if err := json.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", path, err)
 	}
+	return mapping, nil
+}
 
-	if target, exists := cmakeTargetMap[depName]; exists {
-		return target
+// applyCMakeTargets attaches the mapped targets; cmake_target keeps the first
+// target of the package itself for older clients
+func applyCMakeTargets(pkg *Package, mapping map[string][]CMakeTarget) {
+	pkg.CMakeTargets = mapping[pkg.Name]
+	for _, target := range pkg.CMakeTargets {
+		if target.Feature == "" {
+			pkg.CMakeTarget = target.Target
+			return
+		}
 	}
-	return depName // If no mapping exists, return the original name
 }
 
 // Transform method converts RawPackage to the refined Package structure
 func (rp *RawPackage) Transform() (Package, error) {
-	var dependencyList []string
+	var dependencyList []Dependency
 
 	// Handle mixed dependencies (strings and objects)
 	var mixedDeps []interface{}
-	if err := json.Unmarshal(rp.Dependencies, &mixedDeps); err != nil {
-		return Package{}, err
+	if len(rp.Dependencies) > 0 {
+		if err := json.Unmarshal(rp.Dependencies, &mixedDeps); err != nil {
+			return Package{}, err
+		}
 	}
 
 	for _, dep := range mixedDeps {
-		switch depType := dep.(type) {
-		case string:
-			dependencyList = append(dependencyList, depType)
-		case map[string]interface{}:
-			depName := depType["name"].(string)
-			dependencyList = append(dependencyList, depName)
-		default:
-			fmt.Printf("Unknown dependency type: %T\n", depType)
+		if parsed, ok := parseDependency(dep); ok {
+			dependencyList = append(dependencyList, parsed)
+		} else {
+			fmt.Printf("Unknown dependency type: %T\n", dep)
 		}
 	}
 
 	// Handle description
+	// Some ports have no description at all
 	var description string
-	if err := json.Unmarshal(rp.Description, &description); err != nil {
-		var descriptions []string
-		if err := json.Unmarshal(rp.Description, &descriptions); err == nil {
-			description = strings.Join(descriptions, ", ")
-		} else {
-			return Package{}, err
+	if len(rp.Description) > 0 {
+		if err := json.Unmarshal(rp.Description, &description); err != nil {
+			var descriptions []string
+			if err := json.Unmarshal(rp.Description, &descriptions); err == nil {
+				description = strings.Join(descriptions, ", ")
+			} else {
+				return Package{}, err
+			}
 		}
 	}
 
-	// Get CMake target
-	cmakeTarget := MapDependencyToCMakeTarget(rp.Name)
-
 	// Handle features
 	featuresMap := make(map[string]Feature)
 	if len(rp.Features) > 0 {
@@ -205,196 +315,437 @@ func (rp *RawPackage) Transform() (Package, error) {
 					featureDescription = strings.Join(descArray, ", ")
 				}
 
-				var featureDeps []string
-				var requiredFeatures []string
+				var featureDeps []Dependency
+				var requiredFeatures []FeatureRequirement
 				if depList, ok := featMap["dependencies"].([]interface{}); ok {
 					for _, dep := range depList {
-						switch depVal := dep.(type) {
-						case string:
-							featureDeps = append(featureDeps, depVal)
-						case map[string]interface{}:
-							depName := depVal["name"].(string)
-							if depName == rp.Name {
-								requiredFeatures = append(requiredFeatures, featName)
-							} else {
-								featureDeps = append(featureDeps, depName)
-							}
-						default:
+						parsed, ok := parseDependency(dep)
+						if !ok {
 							fmt.Printf("Unknown feature dependency type: %T\n", dep)
+							continue
+						}
+						// A dependency on the package itself only turns on more of its features
+						required := parsed.Name
+						if parsed.Name == rp.Name {
+							required = ""
+						} else {
+							featureDeps = append(featureDeps, parsed)
+						}
+						for _, f := range parsed.Features {
+							if f != "core" {
+								requiredFeatures = append(requiredFeatures, FeatureRequirement{Package: required, Feature: f, Platform: parsed.Platform})
+							}
 						}
 					}
 				}
 
+				featureSupports, _ := featMap["supports"].(string)
+
 				featuresMap[featName] = Feature{
 					Description:      featureDescription,
 					RequiredFeatures: requiredFeatures,
 					Dependencies:     featureDeps,
+					Supports:         featureSupports,
 				}
 			}
 		}
 	}
 
 	pkg := Package{
-		Name:         rp.Name,
-		Version:      rp.Version, // This will be replaced by the tag we fetch
-		Description:  description,
-		GitURL:       rp.GitURL,
-		License:      rp.License,
-		Supports:     rp.Supports,
-		Stars:        rp.Stars,
-		LastModified: rp.LastModified,
-		Dependencies: dependencyList,
-		Features:     featuresMap,
-		CMakeTarget:  cmakeTarget,
-	}
-
-	// Fetch the latest git tag and update the Version
-	err := getRemoteVersions(&pkg)
-	if err != nil {
-		fmt.Printf("Error fetching remote versions for %s: %v\n", pkg.Name, err)
+		Name:            rp.Name,
+		Version:         rp.Version, // This will be replaced by the tag we fetch
+		ManifestVersion: rp.Version,
+		PortVersion:     rp.PortVersion,
+		Description:     description,
+		Homepage:        rp.Homepage,
+		License:         rp.License,
+		Supports:        rp.Supports,
+		Stars:           rp.Stars,
+		LastModified:    rp.LastModified,
+		Dependencies:    dependencyList,
+		Features:        featuresMap,
+		DefaultFeatures: rp.DefaultFeatures,
+		CMakeTarget:     rp.Name,
 	}
 
+	// Tags are discovered afterwards for all packages at once, see discoverTags
 	return pkg, nil
 }
 
-func writeToSQLite(transformedPackages []Package) error {
+// writeToSQLite brings the database at path in line with the transformed
+// packages, in a single transaction. sourceNames lists every package of the
+// source, including those that failed to transform.
+func writeToSQLite(path string, transformedPackages []Package, sourceNames map[string]bool) (IngestReport, error) {
+	report := IngestReport{Added: []string{}, Removed: []string{}, Changed: []PackageChange{}, Kept: []PackageChange{}, TagFailures: []TagFailure{}}
+
 	// Connect to SQLite database
-	db, err := sql.Open("sqlite3", "data.sql")
+	db, err := sql.Open("sqlite3", path)
 	if err != nil {
-		return fmt.Errorf("error opening SQLite database: %v", err)
+		return report, fmt.Errorf("error opening SQLite database: %v", err)
 	}
 	defer db.Close()
 
-	// Create tables if not already present
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS packages (
-		name TEXT PRIMARY KEY,
-		version TEXT,
-		description TEXT,
-		git_url TEXT,
-		license TEXT,
-		supports TEXT,
-		stars INTEGER,
-		last_modified TEXT,
-		cmake_target TEXT
-	);
-
-	CREATE TABLE IF NOT EXISTS dependencies (
-		package_name TEXT,
-		dependency_name TEXT,
-		FOREIGN KEY (package_name) REFERENCES packages(name)
-	);
-
-	CREATE TABLE IF NOT EXISTS features (
-		package_name TEXT,
-		feature_name TEXT,
-		description TEXT,
-		FOREIGN KEY (package_name) REFERENCES packages(name)
-	);
-
-	CREATE TABLE IF NOT EXISTS feature_dependencies (
-		package_name TEXT,
-		feature_name TEXT,
-		dependency_name TEXT,
-		FOREIGN KEY (package_name) REFERENCES packages(name),
-		FOREIGN KEY (feature_name) REFERENCES features(feature_name)
-	);
-	`
-
-	_, err = db.Exec(createTableSQL)
+	// Bring the staging copy to the schema this build writes
+	if _, err := schema.SQLite.Up(db, 0); err != nil {
+		return report, fmt.Errorf("error migrating database schema: %v", err)
+	}
+
+	tx, err := db.Begin()
 	if err != nil {
-		return fmt.Errorf("error creating tables: %v", err)
+		return report, fmt.Errorf("error starting transaction: %v", err)
 	}
+	defer tx.Rollback()
 
-	// Insert transformed packages
-	for _, pkg := range transformedPackages {
-		_, err = db.Exec(
-			`INSERT INTO packages (name, version, description, git_url, license, supports, stars, last_modified, cmake_target)
-			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-			 ON CONFLICT(name) DO UPDATE SET version=excluded.version`,
-			pkg.Name, pkg.Version, pkg.Description, pkg.GitURL, pkg.License, pkg.Supports, pkg.Stars, pkg.LastModified, pkg.CMakeTarget,
-		)
-		if err != nil {
-			return fmt.Errorf("error inserting package %s: %v", pkg.Name, err)
+	if err := dedupeRows(tx); err != nil {
+		return report, err
+	}
+	stored, err := loadStoredPackages(tx)
+	if err != nil {
+		return report, err
+	}
+	fromAPI, err := loadAPIPackages(tx)
+	if err != nil {
+		return report, err
+	}
+
+	// Apply each package as a diff against what is already stored
+	for i := range transformedPackages {
+		pkg := &transformedPackages[i]
+		if old, ok := stored[pkg.Name]; ok && old.RepositorySource == repositoryFromAPI {
+			pkg.GitURL, pkg.RepositorySource = old.GitURL, old.RepositorySource
+		}
+		// Packages created or edited through the API are left as they are,
+		// the report lists what the source would have changed
+		if fromAPI[pkg.Name] {
+			report.Kept = append(report.Kept, PackageChange{Name: pkg.Name, Changes: diffPackage(stored[pkg.Name], pkg)})
+			continue
+		}
+		if err := writeCMakeTargets(tx, pkg); err != nil {
+			return report, err
+		}
+		// A repository that could not be reached keeps its last known version
+		// rather than falling back to the manifest one until the next run
+		if old, ok := stored[pkg.Name]; ok && pkg.TagError != "" {
+			pkg.Version = old.Version
 		}
 
-		// Insert dependencies
-		for _, dep := range pkg.Dependencies {
-			_, err = db.Exec(
-				`INSERT INTO dependencies (package_name, dependency_name) VALUES (?, ?)`,
-				pkg.Name, dep,
-			)
-			if err != nil {
-				return fmt.Errorf("error inserting dependency %s for package %s: %v", dep, pkg.Name, err)
+		if old, ok := stored[pkg.Name]; !ok {
+			if err := insertPackage(tx, pkg); err != nil {
+				return report, err
+			}
+			report.Added = append(report.Added, pkg.Name)
+		} else if changes := diffPackage(old, pkg); len(changes) > 0 {
+			if err := updatePackage(tx, old, pkg); err != nil {
+				return report, err
 			}
+			report.Changed = append(report.Changed, PackageChange{Name: pkg.Name, Changes: changes})
+		} else {
+			report.Unchanged++
 		}
 
-		// Insert features and their dependencies
-		for featName, feat := range pkg.Features {
-			_, err = db.Exec(
-				`INSERT INTO features (package_name, feature_name, description) VALUES (?, ?, ?)`,
-				pkg.Name, featName, feat.Description,
-			)
-			if err != nil {
-				return fmt.Errorf("error inserting feature %s for package %s: %v", featName, pkg.Name, err)
-			}
+		if err := writeVersions(tx, *pkg); err != nil {
+			return report, err
+		}
+	}
 
-			for _, featDep := range feat.Dependencies {
-				_, err = db.Exec(
-					`INSERT INTO feature_dependencies (package_name, feature_name, dependency_name) VALUES (?, ?, ?)`,
-					pkg.Name, featName, featDep,
-				)
-				if err != nil {
-					return fmt.Errorf("error inserting feature dependency %s for feature %s in package %s: %v", featDep, featName, pkg.Name, err)
-				}
-			}
+	// Packages that are gone from the source are dropped. Those that are still
+	// listed but failed to transform keep their last good state, and so do
+	// those created or edited through the API.
+	var vanished []string
+	for name := range stored {
+		if !sourceNames[name] {
+			vanished = append(vanished, name)
+		}
+	}
+	sort.Strings(vanished)
+	for _, name := range vanished {
+		if fromAPI[name] {
+			report.Kept = append(report.Kept, PackageChange{Name: name})
+			continue
+		}
+		if err := deleteStoredPackage(tx, name); err != nil {
+			return report, err
+		}
+		report.Removed = append(report.Removed, name)
+	}
+
+	// Rebuild the full-text search index so it matches the reloaded data
+	if err := schema.RebuildSearchIndex(tx); err != nil {
+		return report, fmt.Errorf("error rebuilding search index: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return report, fmt.Errorf("error committing ingest: %v", err)
+	}
+	return report, nil
+}
+
+// writeCMakeTargets replaces the mapped targets of a package, unless they
+// were edited through the admin endpoints since
+func writeCMakeTargets(db dbConn, pkg *Package) error {
+	var edited bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM cmake_targets WHERE package_name = ? AND source = 'admin')", pkg.Name).Scan(&edited)
+	if err != nil {
+		return fmt.Errorf("error reading cmake targets for package %s: %v", pkg.Name, err)
+	}
+	if edited {
+		// Keep the cmake_target the admin edit chose as well
+		err := db.QueryRow("SELECT COALESCE(cmake_target, '') FROM packages WHERE name = ?", pkg.Name).Scan(&pkg.CMakeTarget)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("error reading cmake target for package %s: %v", pkg.Name, err)
+		}
+		return nil
+	}
+	if _, err := db.Exec("DELETE FROM cmake_targets WHERE package_name = ?", pkg.Name); err != nil {
+		return fmt.Errorf("error clearing cmake targets for package %s: %v", pkg.Name, err)
+	}
+	for _, target := range pkg.CMakeTargets {
+		_, err := db.Exec(
+			`INSERT INTO cmake_targets (package_name, feature_name, find_package, component, target, module, source) VALUES (?, ?, ?, ?, ?, ?, 'mapping')`,
+			pkg.Name, target.Feature, target.FindPackage, target.Component, target.Target, target.Module,
+		)
+		if err != nil {
+			return fmt.Errorf("error inserting cmake target %s for package %s: %v", target.Target, pkg.Name, err)
 		}
 	}
 	return nil
 }
 
-func main() {
-	// Open the JSON file
-	file, err := os.Open("data.json")
+// writeVersions records every discovered version of pkg. A version keeps the
+// dependency and feature snapshot taken when it was first seen, so only new
+// versions get the current manifest.
+// writeVersions records every discovered version of pkg. Only the tag of the
+// manifest's version gets its dependencies and features; the manifests of the
+// other tags were never read, so theirs are stored as NULL, unknown.
+func writeVersions(db dbConn, pkg Package) error {
+	dependencies, err := json.Marshal(pkg.Dependencies)
+	if err != nil {
+		return err
+	}
+	features, err := json.Marshal(pkg.Features)
+	if err != nil {
+		return err
+	}
+	snapshot := &versionSnapshot{string(dependencies), string(features)}
+
+	described := false
+	for _, ref := range pkg.Refs {
+		if semver.Compare(ref.Name, pkg.ManifestVersion) == 0 && !described {
+			described = true
+			err = writeVersion(db, pkg, ref.Name, ref, snapshot)
+		} else {
+			err = writeVersion(db, pkg, ref.Name, ref, nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !described {
+		// No tag matches the manifest, record its version under its own name
+		if err := writeVersion(db, pkg, pkg.ManifestVersion, GitRef{}, snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// versionSnapshot is the JSON of the dependencies and features of a version
+type versionSnapshot struct {
+	dependencies, features string
+}
+
+// writeVersion upserts a version, with snapshot nil when its manifest is unknown
+func writeVersion(db dbConn, pkg Package, version string, ref GitRef, snapshot *versionSnapshot) error {
+	releaseDate := ""
+	portVersion := 0
+	var dependencies, features interface{}
+	if snapshot != nil {
+		releaseDate = pkg.LastModified
+		portVersion = pkg.PortVersion
+		dependencies, features = snapshot.dependencies, snapshot.features
+	}
+	// A snapshot fills in a version seen only as a tag so far, and a new port
+	// revision refreshes it
+	_, err := db.Exec(
+		`INSERT INTO package_versions (package_name, version, port_version, tag, release_date, dependencies, features)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT(package_name, version) DO UPDATE SET
+			port_version = excluded.port_version, release_date = excluded.release_date,
+			dependencies = excluded.dependencies, features = excluded.features
+		 WHERE excluded.dependencies IS NOT NULL AND (package_versions.dependencies IS NULL
+			OR excluded.port_version > COALESCE(package_versions.port_version, 0))`,
+		pkg.Name, version, portVersion, ref.Name, releaseDate, dependencies, features,
+	)
+	if err != nil {
+		return fmt.Errorf("error inserting version %s for package %s: %v", version, pkg.Name, err)
+	}
+	if ref.Name == "" {
+		return nil
+	}
+	// Branches move and tags can be recreated, so the ref always reflects the latest listing
+	_, err = db.Exec(
+		"UPDATE package_versions SET ref_type = ?, object_sha = ?, commit_sha = ? WHERE package_name = ? AND version = ?",
+		ref.Type, ref.Object, ref.Commit, pkg.Name, version,
+	)
+	if err != nil {
+		return fmt.Errorf("error updating the ref of version %s for package %s: %v", version, pkg.Name, err)
+	}
+	return nil
+}
+
+// checkSQLite makes sure the linked SQLite can write the schema
+func checkSQLite() error {
+	db, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
-		fmt.Printf("Error opening file: %v\n", err)
-		return
+		return fmt.Errorf("error opening SQLite database: %v", err)
+	}
+	defer db.Close()
+	return schema.CheckFTS5(db)
+}
+
+// readOutputJSON reads the aggregated output.json downloaded by data.sh
+func readOutputJSON(path string) ([]RawPackage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
 	}
 	defer file.Close()
 
 	// Decode the root JSON structure
 	var root Root
 	if err := json.NewDecoder(file).Decode(&root); err != nil {
-		fmt.Printf("Error decoding JSON: %v\n", err)
-		return
+		return nil, fmt.Errorf("error decoding JSON: %v", err)
+	}
+	return root.Source, nil
+}
+
+// defaultDatabasePath is the database the server opens: DATABASE_URL when
+// it uses SQLite, else its ./data.sql, seen from clean/ where ingest runs
+func defaultDatabasePath() string {
+	if url := os.Getenv("DATABASE_URL"); url != "" && (os.Getenv("DATABASE_DRIVER") == "" || os.Getenv("DATABASE_DRIVER") == "sqlite3") {
+		return url
+	}
+	return "../data.sql"
+}
+
+func main() {
+	os.Exit(run())
+}
+
+// run ingests the packages and returns the exit code
+func run() int {
+	dataPath := flag.String("data", "data.json", "aggregated vcpkg output.json to read")
+	portsDir := flag.String("ports", "", "read ports/*/vcpkg.json from this directory instead of -data")
+	var overlays stringList
+	flag.Var(&overlays, "overlay", "overlay ports directory, taking precedence over -ports (repeatable)")
+	allowShrink := flag.Bool("allow-shrink", false, "accept a snapshot with less than half the packages of the live database")
+	reportPath := flag.String("report", "ingest_report.json", "write the change report of this run here, empty to skip")
+	livePath := flag.String("db", defaultDatabasePath(), "SQLite database the server reads, replaced by the new snapshot")
+	var tagOpts tagOptions
+	flag.IntVar(&tagOpts.Concurrency, "concurrency", 16, "number of repositories to list tags from at once")
+	flag.DurationVar(&tagOpts.Timeout, "git-timeout", 30*time.Second, "time limit for listing the tags of one repository")
+	flag.IntVar(&tagOpts.Retries, "git-retries", 2, "retries for a repository whose tags could not be listed")
+	flag.DurationVar(&tagOpts.Backoff, "git-backoff", time.Second, "delay before the first retry, doubled on each further retry")
+	flag.Parse()
+
+	// Fail before the slow tag discovery rather than when writing the snapshot
+	if err := checkSQLite(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return 1
+	}
+
+	var source []RawPackage
+	var err error
+	if *portsDir != "" || len(overlays) > 0 {
+		source, err = readPortsTree(*portsDir, overlays)
+	} else {
+		source, err = readOutputJSON(*dataPath)
+	}
+	if err != nil {
+		fmt.Printf("Error reading packages: %v\n", err)
+		return 1
+	}
+
+	cmakeTargets, err := loadCMakeTargets("cmake_targets.json")
+	if err != nil {
+		fmt.Printf("Error loading CMake targets: %v\n", err)
+		return 1
+	}
+	repositories, err := loadRepositoryOverrides("repositories.json")
+	if err != nil {
+		fmt.Printf("Error loading repository overrides: %v\n", err)
+		return 1
+	}
+	// Read ahead of the tag discovery, writeToSQLite checks them again
+	apiRepositories, err := loadAPIRepositories(*livePath)
+	if err != nil {
+		fmt.Printf("Error loading repositories set through the API: %v\n", err)
+		return 1
 	}
 
 	var transformedPackages []Package
+	sourceNames := make(map[string]bool)
 
-	for _, rawPkg := range root.Source {
+	for _, rawPkg := range source {
+		sourceNames[rawPkg.Name] = true
 		transformedPkg, err := rawPkg.Transform()
 		if err != nil {
-			fmt.Printf("Error transforming package: %v\n", err)
+			fmt.Printf("Error transforming package %s: %v\n", rawPkg.Name, err)
 			continue
 		}
+		applyCMakeTargets(&transformedPkg, cmakeTargets)
+		resolveRepository(&transformedPkg, rawPkg.PortDir, apiRepositories, repositories)
 		transformedPackages = append(transformedPackages, transformedPkg)
 	}
+	tagFailures := discoverTags(transformedPackages, tagOpts)
 
 	// Write the transformed packages to a new JSON file
 	outputFile, err := os.Create("transformed_data.json")
 	if err != nil {
 		fmt.Printf("Error creating file: %v\n", err)
-		return
+		return 1
 	}
 	defer outputFile.Close()
 
 	if err := json.NewEncoder(outputFile).Encode(transformedPackages); err != nil {
 		fmt.Printf("Error encoding transformed data: %v\n", err)
-		return
+		return 1
+	}
+	// Build the new snapshot next to the live database and swap it in only
+	// once it is complete, so the server never sees a partial ingest
+	stagingPath := *livePath + ".staging"
+	unlock, err := prepareStaging(*livePath, stagingPath)
+	if err != nil {
+		fmt.Printf("Error preparing staging database: %v\n", err)
+		return 1
 	}
-	if err := writeToSQLite(transformedPackages); err != nil {
+	// Deferred so the lock outlives the rename below
+	defer unlock()
+	report, err := writeToSQLite(stagingPath, transformedPackages, sourceNames)
+	if err == nil {
+		err = validateStaging(stagingPath, *livePath, len(transformedPackages), *allowShrink)
+	}
+	if err != nil {
 		fmt.Printf("Error writing to SQLite: %v\n", err)
-		return
+		os.Remove(stagingPath)
+		return 1
+	}
+	if err := os.Rename(stagingPath, *livePath); err != nil {
+		fmt.Printf("Error swapping in the new database: %v\n", err)
+		return 1
+	}
+	report.TagFailures = tagFailures
+	printReport(report)
+
+	if *reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*reportPath, data, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Error writing ingest report: %v\n", err)
+			return 1
+		}
 	}
 	fmt.Println("Transformed data written successfully!")
+	return 0
 }
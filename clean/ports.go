@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Manifest is a port's vcpkg.json. Only one of the version fields is set,
+// depending on the versioning scheme the port uses.
+type Manifest struct {
+	Name            string           `json:"name"`
+	Version         string           `json:"version"`
+	VersionSemver   string           `json:"version-semver"`
+	VersionDate     string           `json:"version-date"`
+	VersionString   string           `json:"version-string"`
+	PortVersion     int              `json:"port-version"`
+	Description     json.RawMessage  `json:"description"`
+	Homepage        string           `json:"homepage"`
+	License         string           `json:"license"`
+	Supports        string           `json:"supports"`
+	Dependencies    json.RawMessage  `json:"dependencies"`
+	DefaultFeatures []DefaultFeature `json:"default-features"`
+	Features        json.RawMessage  `json:"features"`
+}
+
+// version returns whichever version field the manifest uses
+func (m Manifest) version() string {
+	for _, v := range []string{m.Version, m.VersionSemver, m.VersionDate, m.VersionString} {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// readManifest parses a vcpkg.json into the shape of an output.json entry
+func readManifest(path string) (RawPackage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RawPackage{}, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return RawPackage{}, fmt.Errorf("error decoding %s: %v", path, err)
+	}
+	if m.Name == "" {
+		return RawPackage{}, fmt.Errorf("%s has no name", path)
+	}
+
+	lastModified := ""
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime().UTC().Format("2006-01-02")
+	}
+	return RawPackage{
+		Name:            m.Name,
+		Version:         m.version(),
+		PortVersion:     m.PortVersion,
+		Description:     m.Description,
+		Homepage:        m.Homepage,
+		License:         m.License,
+		Supports:        m.Supports,
+		LastModified:    lastModified,
+		Dependencies:    m.Dependencies,
+		Features:        m.Features,
+		DefaultFeatures: m.DefaultFeatures,
+		PortDir:         filepath.Dir(path),
+	}, nil
+}
+
+// readPortDir reads either a single port directory or a directory of ports
+func readPortDir(dir string) ([]RawPackage, error) {
+	if _, err := os.Stat(filepath.Join(dir, "vcpkg.json")); err == nil {
+		rp, err := readManifest(filepath.Join(dir, "vcpkg.json"))
+		if err != nil {
+			return nil, err
+		}
+		return []RawPackage{rp}, nil
+	}
+
+	manifests, err := filepath.Glob(filepath.Join(dir, "*", "vcpkg.json"))
+	if err != nil {
+		return nil, err
+	}
+	var packages []RawPackage
+	for _, path := range manifests {
+		rp, err := readManifest(path)
+		if err != nil {
+			// One broken port should not stop the whole tree from indexing
+			fmt.Printf("Error reading port manifest: %v\n", err)
+			continue
+		}
+		packages = append(packages, rp)
+	}
+	return packages, nil
+}
+
+// readPortsTree reads the ports of a vcpkg checkout. Overlays take precedence
+// over the ports directory and over later overlays, like vcpkg --overlay-ports.
+func readPortsTree(portsDir string, overlays []string) ([]RawPackage, error) {
+	seen := make(map[string]bool)
+	var packages []RawPackage
+	for _, dir := range append(append([]string{}, overlays...), portsDir) {
+		if dir == "" {
+			continue
+		}
+		ports, err := readPortDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, rp := range ports {
+			if seen[rp.Name] {
+				continue
+			}
+			seen[rp.Name] = true
+			packages = append(packages, rp)
+		}
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].Name < packages[j].Name })
+	return packages, nil
+}
+
+// stringList collects a repeatable command line flag
+type stringList []string
+
+func (l *stringList) String() string { return fmt.Sprint(*l) }
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
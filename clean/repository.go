@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// How a package's repository URL was derived, stored as repository_source
+const (
+	repositoryFromAPI      = "api" // set through the server, never replaced by ingest
+	repositoryFromOverride = "override"
+	repositoryFromPortfile = "portfile"
+	repositoryFromHomepage = "homepage"
+)
+
+// gitHosts are the hosting services whose project pages are also clone URLs
+var gitHosts = map[string]bool{
+	"github.com":    true,
+	"gitlab.com":    true,
+	"codeberg.org":  true,
+	"bitbucket.org": true,
+}
+
+// projectPages maps project sites hosted by a git service, or with a
+// well-known mirror, to their repository
+var projectPages = []struct {
+	pattern  *regexp.Regexp
+	template string
+}{
+	{regexp.MustCompile(`^https?://([A-Za-z0-9-]+)\.github\.io/([A-Za-z0-9._-]+)`), "https://github.com/$1/$2"},
+	{regexp.MustCompile(`^https?://([A-Za-z0-9-]+)\.gitlab\.io/([A-Za-z0-9._-]+)`), "https://gitlab.com/$1/$2"},
+	{regexp.MustCompile(`^https?://(?:www\.)?boost\.org/libs/([A-Za-z0-9_]+)`), "https://github.com/boostorg/$1"},
+}
+
+// Source download calls of a portfile.cmake that name the upstream repository
+var (
+	portfileCall   = regexp.MustCompile(`(?s)vcpkg_from_(github|gitlab|git|bitbucket)\s*\((.*?)\)`)
+	portfileOption = regexp.MustCompile(`\b(REPO|URL|GITLAB_URL)\s+"?([^\s")]+)"?`)
+)
+
+// loadRepositoryOverrides reads the curated package to repository URL file.
+// A missing file is not an error.
+func loadRepositoryOverrides(path string) (map[string]string, error) {
+	overrides := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return overrides, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", path, err)
+	}
+	return overrides, nil
+}
+
+// resolveRepository sets pkg.GitURL from, in order of preference, the URL set
+// through the API, the override file, the port's portfile.cmake and the
+// homepage, and records which one it used
+func resolveRepository(pkg *Package, portDir string, fromAPI, overrides map[string]string) {
+	if repo, ok := fromAPI[pkg.Name]; ok {
+		pkg.GitURL, pkg.RepositorySource = repo, repositoryFromAPI
+		return
+	}
+	if repo, ok := overrides[pkg.Name]; ok {
+		pkg.GitURL, pkg.RepositorySource = repo, repositoryFromOverride
+		return
+	}
+	if portDir != "" {
+		if repo := repositoryFromPortfileCalls(filepath.Join(portDir, "portfile.cmake")); repo != "" {
+			pkg.GitURL, pkg.RepositorySource = repo, repositoryFromPortfile
+			return
+		}
+	}
+	if repo := repositoryFromHostingURL(pkg.Homepage); repo != "" {
+		pkg.GitURL, pkg.RepositorySource = repo, repositoryFromHomepage
+		return
+	}
+	pkg.GitURL, pkg.RepositorySource = "", ""
+}
+
+// repositoryFromHostingURL turns a page on a known git host into the URL of
+// its repository, for example https://github.com/fmtlib/fmt/releases into
+// https://github.com/fmtlib/fmt. Unknown sites give an empty string.
+func repositoryFromHostingURL(page string) string {
+	page = strings.TrimSpace(page)
+	for _, p := range projectPages {
+		if m := p.pattern.FindStringSubmatchIndex(page); m != nil {
+			return string(p.pattern.ExpandString(nil, p.template, page, m))
+		}
+	}
+
+	u, err := url.Parse(page)
+	if err != nil {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	if !gitHosts[host] {
+		return ""
+	}
+
+	// GitLab allows nested groups and separates project pages with /-/
+	projectPath, _, _ := strings.Cut(strings.Trim(u.Path, "/"), "/-/")
+	segments := strings.Split(projectPath, "/")
+	if host != "gitlab.com" && len(segments) > 2 {
+		segments = segments[:2]
+	}
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return ""
+	}
+	segments[len(segments)-1] = strings.TrimSuffix(segments[len(segments)-1], ".git")
+	return "https://" + host + "/" + strings.Join(segments, "/")
+}
+
+// repositoryFromPortfileCalls finds the repository a portfile downloads its
+// sources from, or an empty string when it uses none of the known helpers
+func repositoryFromPortfileCalls(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	for _, call := range portfileCall.FindAllStringSubmatch(string(data), -1) {
+		options := make(map[string]string)
+		for _, option := range portfileOption.FindAllStringSubmatch(call[2], -1) {
+			if _, seen := options[option[1]]; !seen {
+				options[option[1]] = option[2]
+			}
+		}
+		// Options built from CMake variables cannot be resolved here
+		if strings.Contains(options["REPO"]+options["URL"]+options["GITLAB_URL"], "${") {
+			continue
+		}
+
+		switch call[1] {
+		case "github":
+			if options["REPO"] != "" {
+				return "https://github.com/" + options["REPO"]
+			}
+		case "bitbucket":
+			if options["REPO"] != "" {
+				return "https://bitbucket.org/" + options["REPO"]
+			}
+		case "gitlab":
+			if options["GITLAB_URL"] != "" && options["REPO"] != "" {
+				return strings.TrimSuffix(options["GITLAB_URL"], "/") + "/" + options["REPO"]
+			}
+		case "git":
+			if options["URL"] != "" {
+				return options["URL"]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/frate-packages/package-server/schema"
+)
+
+// prepareStaging copies the live database to a staging file, or leaves the
+// staging path empty when there is no live database yet. It keeps the write
+// lock of the live file until unlock is called, which must only happen once
+// the staging file was renamed over it: the server cannot commit a write that
+// the swap would drop, and refuses writes that waited on the lock.
+func prepareStaging(livePath, stagingPath string) (unlock func(), err error) {
+	if err := os.Remove(stagingPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error removing old staging database: %v", err)
+	}
+	if _, err := os.Stat(livePath); os.IsNotExist(err) {
+		return func() {}, nil
+	}
+
+	// BEGIN IMMEDIATE takes the write lock; readers are not blocked
+	live, err := sql.Open("sqlite3", livePath+"?_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("error opening SQLite database: %v", err)
+	}
+	lock, err := live.Begin()
+	if err != nil {
+		live.Close()
+		return nil, fmt.Errorf("error locking %s: %v", livePath, err)
+	}
+	unlock = func() {
+		lock.Rollback()
+		live.Close()
+	}
+	if _, err := live.Exec("VACUUM INTO ?", stagingPath); err != nil {
+		unlock()
+		return nil, fmt.Errorf("error copying %s to %s: %v", livePath, stagingPath, err)
+	}
+	return unlock, nil
+}
+
+// validateStaging checks a staging database before it replaces the live one.
+// A staging database with less than half the packages of the live one is
+// refused unless allowShrink is set, since that usually means a broken source.
+func validateStaging(stagingPath, livePath string, expected int, allowShrink bool) error {
+	staging, err := sql.Open("sqlite3", stagingPath)
+	if err != nil {
+		return fmt.Errorf("error opening staging database: %v", err)
+	}
+	defer staging.Close()
+
+	var integrity string
+	if err := staging.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil {
+		return fmt.Errorf("error checking staging database integrity: %v", err)
+	}
+	if integrity != "ok" {
+		return fmt.Errorf("staging database failed the integrity check: %s", integrity)
+	}
+	if err := schema.SQLite.Check(staging); err != nil {
+		return fmt.Errorf("staging database: %v", err)
+	}
+
+	var packages, indexed int
+	if err := staging.QueryRow("SELECT COUNT(*) FROM packages").Scan(&packages); err != nil {
+		return fmt.Errorf("error counting staged packages: %v", err)
+	}
+	if packages < expected {
+		return fmt.Errorf("staging database has %d packages, expected at least %d", packages, expected)
+	}
+	if err := staging.QueryRow("SELECT COUNT(*) FROM packages_fts").Scan(&indexed); err != nil {
+		return fmt.Errorf("error counting the search index: %v", err)
+	}
+	if indexed != packages {
+		return fmt.Errorf("search index has %d rows for %d packages", indexed, packages)
+	}
+
+	for _, table := range []string{"dependencies", "features", "feature_dependencies", "feature_requirements", "default_features", "cmake_targets", "package_versions"} {
+		var orphans int
+		err := staging.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE package_name NOT IN (SELECT name FROM packages)").Scan(&orphans)
+		if err != nil {
+			return fmt.Errorf("error checking %s: %v", table, err)
+		}
+		if orphans > 0 {
+			return fmt.Errorf("%s has %d rows for packages that do not exist", table, orphans)
+		}
+	}
+
+	if allowShrink {
+		return nil
+	}
+	if _, err := os.Stat(livePath); os.IsNotExist(err) {
+		return nil
+	}
+	live, err := sql.Open("sqlite3", livePath)
+	if err != nil {
+		return fmt.Errorf("error opening SQLite database: %v", err)
+	}
+	defer live.Close()
+	var current int
+	if err := live.QueryRow("SELECT COUNT(*) FROM packages").Scan(&current); err != nil {
+		// A live database without packages has nothing to lose
+		return nil
+	}
+	if packages*2 < current {
+		return fmt.Errorf("staging database has %d packages where the live one has %d, rerun with -allow-shrink if this is intended", packages, current)
+	}
+	return nil
+}
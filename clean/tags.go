@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/frate-packages/package-server/semver"
+)
+
+// tagOptions controls remote tag discovery
+type tagOptions struct {
+	Concurrency int
+	Timeout     time.Duration
+	Retries     int
+	Backoff     time.Duration
+}
+
+// TagFailure records a package whose tags could not be listed
+type TagFailure struct {
+	Name     string `json:"name"`
+	GitURL   string `json:"git_url"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error"`
+}
+
+// GitRef is a tag or branch listed by git ls-remote. Object is the SHA the
+// ref points to, Commit the commit it resolves to: for an annotated tag Object
+// is the tag object and Commit comes from its peeled ^{} entry.
+type GitRef struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Object string `json:"object"`
+	Commit string `json:"commit"`
+}
+
+// parseRemoteRefs reads git ls-remote output into the refs that name a
+// version, ordered from oldest to newest. Names keep their full path below
+// refs/tags/ or refs/heads/, so release/1.2 stays distinct from 1.2.
+func parseRemoteRefs(output string) []GitRef {
+	byRef := make(map[string]*GitRef)
+	for _, line := range strings.Split(output, "\n") {
+		sha, ref, ok := strings.Cut(strings.TrimSpace(line), "\t")
+		if !ok {
+			continue
+		}
+		peeled := strings.HasSuffix(ref, "^{}")
+		ref = strings.TrimSuffix(ref, "^{}")
+
+		r := GitRef{Type: "tag"}
+		if r.Name, ok = strings.CutPrefix(ref, "refs/tags/"); !ok {
+			if r.Name, ok = strings.CutPrefix(ref, "refs/heads/"); !ok {
+				continue
+			}
+			r.Type = "branch"
+		}
+		if !validateVersionName(path.Base(r.Name)) {
+			continue
+		}
+
+		existing, ok := byRef[ref]
+		if !ok {
+			existing = &r
+			byRef[ref] = existing
+		}
+		if peeled {
+			existing.Commit = sha
+		} else {
+			existing.Object = sha
+			if existing.Commit == "" {
+				existing.Commit = sha
+			}
+		}
+	}
+
+	// A branch and a tag can share a name, the tag wins
+	byName := make(map[string]GitRef)
+	for _, r := range byRef {
+		if other, ok := byName[r.Name]; !ok || other.Type == "branch" {
+			byName[r.Name] = *r
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	semver.SortTags(names)
+
+	refs := make([]GitRef, len(names))
+	for i, name := range names {
+		refs[i] = byName[name]
+	}
+	return refs
+}
+
+// lsRemote runs git ls-remote with a deadline. Git must never wait for
+// credentials, a private or missing repository then fails instead of hanging.
+func lsRemote(gitURL string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "ls-remote", gitURL)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=true")
+	// The context only kills git; helpers like git-remote-https it started
+	// keep the output open, so stop waiting for them shortly after
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// getRemoteVersions sets the package's tags and highest release, retrying with
+// exponential backoff. It returns the number of attempts made.
+func getRemoteVersions(pkg *Package, opts tagOptions) (int, error) {
+	pkg.Versions = []string{}
+	if pkg.GitURL == "" {
+		return 0, nil
+	}
+
+	var out string
+	var err error
+	attempts := 0
+	delay := opts.Backoff
+	for attempts <= opts.Retries {
+		if attempts > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		attempts++
+		if out, err = lsRemote(pkg.GitURL, opts.Timeout); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return attempts, err
+	}
+
+	pkg.Refs = parseRemoteRefs(out)
+	for _, ref := range pkg.Refs {
+		pkg.Versions = append(pkg.Versions, ref.Name)
+	}
+	if latest, ok := semver.Latest(pkg.Versions); ok {
+		pkg.Version = latest
+	}
+	return attempts, nil
+}
+
+// discoverTags lists the tags of every package with a bounded pool of workers,
+// printing progress as it goes. Packages that fail keep their manifest version.
+func discoverTags(packages []Package, opts tagOptions) []TagFailure {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	jobs := make(chan int)
+	var mu sync.Mutex
+	failures := []TagFailure{}
+	var done, failed atomic.Int64
+
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				pkg := &packages[i]
+				attempts, err := getRemoteVersions(pkg, opts)
+				if err != nil {
+					pkg.TagError = err.Error()
+					failed.Add(1)
+					mu.Lock()
+					failures = append(failures, TagFailure{Name: pkg.Name, GitURL: pkg.GitURL, Attempts: attempts, Error: err.Error()})
+					mu.Unlock()
+				}
+				done.Add(1)
+			}
+		}()
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Printf("Fetching tags: %d/%d done, %d failed\n", done.Load(), len(packages), failed.Load())
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for i := range packages {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(stop)
+
+	fmt.Printf("Fetched tags for %d packages in %s, %d failed\n", len(packages), time.Since(start).Round(time.Second), failed.Load())
+	// Workers finish in any order
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Name < failures[j].Name })
+	return failures
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CMakeTarget is an imported target of a package, or of one of its features
+// when Feature is set, together with the find_package call providing it.
+// Module marks packages found through a Find module rather than a config file.
+type CMakeTarget struct {
+	Feature     string `json:"feature,omitempty"`
+	FindPackage string `json:"find_package"`
+	Component   string `json:"component,omitempty"`
+	Target      string `json:"target"`
+	Module      bool   `json:"module,omitempty"`
+}
+
+// CMakeFragment is the response body of /package/cmake and /cmake. Unmapped
+// lists the requested packages whose targets are not known, they have no part
+// in Targets or Fragment.
+type CMakeFragment struct {
+	Packages []string      `json:"packages"`
+	Features []string      `json:"features,omitempty"`
+	Targets  []CMakeTarget `json:"targets"`
+	Unmapped []string      `json:"unmapped,omitempty"`
+	Fragment string        `json:"fragment"`
+}
+
+// cmakeTargetsFor returns the targets a consumer links for the package with
+// the given features, from cmake_targets when the package is mapped there.
+// ok is false when neither cmake_targets nor cmake_target name a target.
+func cmakeTargetsFor(pkg Package, features []string) (targets []CMakeTarget, ok bool, err error) {
+	mapped, err := store.CMakeTargets(pkg.Name)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(mapped) == 0 {
+		targets = guessCMakeTargets(pkg)
+		return targets, targets != nil, nil
+	}
+
+	enabled := make(map[string]bool)
+	for _, feat := range features {
+		enabled[feat] = true
+	}
+	for _, t := range mapped {
+		if t.Feature == "" || enabled[t.Feature] {
+			targets = append(targets, t)
+		}
+	}
+	return targets, true, nil
+}
+
+// guessCMakeTargets derives a target from the single cmake_target column.
+// "Boost::asio" of boost-asio becomes the asio component of Boost. Ingest
+// stores the package name for packages missing from the mapping file, a name
+// without a namespace is no target and gives nil.
+func guessCMakeTargets(pkg Package) []CMakeTarget {
+	mapped := pkg.CMakeTarget
+	namespace, name, found := strings.Cut(mapped, "::")
+	if !found {
+		return nil
+	}
+
+	target := CMakeTarget{FindPackage: namespace, Target: mapped}
+	if prefix, component, ok := strings.Cut(pkg.Name, "-"); ok && strings.EqualFold(prefix, namespace) && strings.EqualFold(component, name) {
+		target.Component = component
+	}
+	return []CMakeTarget{target}
+}
+
+// renderCMake merges the targets into one find_package call per package and a
+// single target_link_libraries call
+func renderCMake(targets []CMakeTarget, consumer string) string {
+	var order []string
+	components := make(map[string][]string)
+	seenComponent := make(map[string]bool)
+	module := make(map[string]bool)
+	for _, t := range targets {
+		module[t.FindPackage] = module[t.FindPackage] || t.Module
+		if _, ok := components[t.FindPackage]; !ok {
+			order = append(order, t.FindPackage)
+			components[t.FindPackage] = nil
+		}
+		if t.Component != "" && !seenComponent[t.FindPackage+"\x00"+t.Component] {
+			seenComponent[t.FindPackage+"\x00"+t.Component] = true
+			components[t.FindPackage] = append(components[t.FindPackage], t.Component)
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range order {
+		b.WriteString("find_package(" + name)
+		if !module[name] {
+			b.WriteString(" CONFIG")
+		}
+		b.WriteString(" REQUIRED")
+		if len(components[name]) > 0 {
+			sort.Strings(components[name])
+			b.WriteString(" COMPONENTS " + strings.Join(components[name], " "))
+		}
+		b.WriteString(")\n")
+	}
+
+	var links []string
+	seenTarget := make(map[string]bool)
+	for _, t := range targets {
+		if !seenTarget[t.Target] {
+			seenTarget[t.Target] = true
+			links = append(links, t.Target)
+		}
+	}
+	if len(links) > 0 {
+		b.WriteString("target_link_libraries(" + consumer + " PRIVATE " + strings.Join(links, " ") + ")\n")
+	}
+	return b.String()
+}
+
+// buildCMakeFragment loads the packages and renders their merged fragment.
+// Features only apply when a single package is requested.
+func buildCMakeFragment(names, features []string, consumer string) (CMakeFragment, error) {
+	fragment := CMakeFragment{Packages: names, Features: features, Targets: []CMakeTarget{}}
+	for _, name := range names {
+		pkg, err := store.Package(name)
+		if err == ErrNotFound {
+			return fragment, &requestError{http.StatusNotFound, "Package " + name + " not found"}
+		} else if err != nil {
+			return fragment, err
+		}
+		for _, feat := range features {
+			if _, ok := pkg.Features[feat]; !ok && feat != "core" {
+				return fragment, &requestError{http.StatusNotFound, "Package " + name + " has no feature " + feat}
+			}
+		}
+		targets, ok, err := cmakeTargetsFor(pkg, features)
+		if err != nil {
+			return fragment, err
+		}
+		if !ok {
+			fragment.Unmapped = append(fragment.Unmapped, name)
+			continue
+		}
+		fragment.Targets = append(fragment.Targets, targets...)
+	}
+	fragment.Fragment = renderCMake(fragment.Targets, consumer)
+	if len(fragment.Unmapped) > 0 {
+		fragment.Fragment = "# No CMake targets known for " + strings.Join(fragment.Unmapped, ", ") + "\n" + fragment.Fragment
+	}
+	return fragment, nil
+}
+
+// writeCMakeFragment writes the fragment as JSON, or as plain CMake with format=text
+func writeCMakeFragment(w http.ResponseWriter, r *http.Request, names, features []string) {
+	consumer := r.URL.Query().Get("target")
+	if consumer == "" {
+		consumer = "main"
+	}
+
+	fragment, err := buildCMakeFragment(names, features, consumer)
+	if rerr, ok := err.(*requestError); ok {
+		http.Error(w, rerr.message, rerr.status)
+		return
+	} else if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(fragment.Fragment))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fragment)
+}
+
+func getPackageCMake(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("name")
+	if packageName == "" {
+		http.Error(w, "Missing package name", http.StatusBadRequest)
+		return
+	}
+	writeCMakeFragment(w, r, []string{packageName}, splitList(r.URL.Query().Get("features")))
+}
+
+func getCMake(w http.ResponseWriter, r *http.Request) {
+	names := splitList(r.URL.Query().Get("names"))
+	if len(names) == 0 {
+		http.Error(w, "Missing package names", http.StatusBadRequest)
+		return
+	}
+	writeCMakeFragment(w, r, names, nil)
+}
+
+// primaryCMakeTarget is the cmake_target column for an edited target list:
+// the first target of the package itself, or its name
+func primaryCMakeTarget(packageName string, targets []CMakeTarget) string {
+	for _, t := range targets {
+		if t.Feature == "" {
+			return t.Target
+		}
+	}
+	return packageName
+}
+
+// adminCMakeTargets handles GET, PUT and DELETE of /admin/cmake_targets/{name}.
+// PUT replaces the whole list and ingest then leaves the package alone;
+// DELETE drops the list so the next ingest loads the mapping file again.
+func adminCMakeTargets(w http.ResponseWriter, r *http.Request) {
+	packageName := r.PathValue("name")
+	pkg, err := store.Package(packageName)
+	if err == ErrNotFound {
+		http.Error(w, "Package not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var targets []CMakeTarget
+		if err := json.NewDecoder(r.Body).Decode(&targets); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		for _, t := range targets {
+			if t.FindPackage == "" || t.Target == "" {
+				http.Error(w, "Every target needs find_package and target", http.StatusBadRequest)
+				return
+			}
+			if _, ok := pkg.Features[t.Feature]; t.Feature != "" && !ok {
+				http.Error(w, "Package "+packageName+" has no feature "+t.Feature, http.StatusBadRequest)
+				return
+			}
+		}
+		if err := store.ReplaceCMakeTargets(packageName, targets); err == ErrWriteUnavailable {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, "Error updating CMake targets", http.StatusInternalServerError)
+			return
+		}
+		invalidatePackage(packageName)
+	case http.MethodDelete:
+		if err := store.DeleteCMakeTargets(packageName); err == ErrWriteUnavailable {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, "Error deleting CMake targets", http.StatusInternalServerError)
+			return
+		}
+		invalidatePackage(packageName)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", "GET, PUT, DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	targets, err := store.CMakeTargets(packageName)
+	if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBuildCMakeFragmentUnmapped(t *testing.T) {
+	useMemoryStore(t,
+		Package{Name: "boost-asio", Version: "1.86.0", CMakeTarget: "Boost::asio"},
+		Package{Name: "fmt", Version: "11.0.2", CMakeTarget: "fmt"},
+		Package{Name: "zlib", Version: "1.3.1"},
+	)
+
+	fragment, err := buildCMakeFragment([]string{"boost-asio", "fmt", "zlib"}, nil, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"fmt", "zlib"}; !slices.Equal(fragment.Unmapped, want) {
+		t.Errorf("unmapped %v, want %v", fragment.Unmapped, want)
+	}
+	want := []CMakeTarget{{FindPackage: "Boost", Component: "asio", Target: "Boost::asio"}}
+	if !slices.Equal(fragment.Targets, want) {
+		t.Errorf("targets %+v, want %+v", fragment.Targets, want)
+	}
+	wantFragment := "# No CMake targets known for fmt, zlib\n" +
+		"find_package(Boost CONFIG REQUIRED COMPONENTS asio)\n" +
+		"target_link_libraries(main PRIVATE Boost::asio)\n"
+	if fragment.Fragment != wantFragment {
+		t.Errorf("fragment\n%s\nwant\n%s", fragment.Fragment, wantFragment)
+	}
+}
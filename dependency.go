@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/frate-packages/package-server/schema"
+)
+
+// Dependency is an edge to another package, in the same shape as a vcpkg
+// manifest dependency. Edges without any qualifiers are encoded as a plain
+// name string, everything else as an object.
+type Dependency struct {
+	Name            string   `json:"name"`
+	Platform        string   `json:"platform,omitempty"`
+	Host            bool     `json:"host,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	DefaultFeatures *bool    `json:"default-features,omitempty"`
+}
+
+// dependencyObject avoids recursing into Dependency's own JSON methods
+type dependencyObject Dependency
+
+func (d Dependency) MarshalJSON() ([]byte, error) {
+	if d.isPlain() {
+		return json.Marshal(d.Name)
+	}
+	return json.Marshal(dependencyObject(d))
+}
+
+func (d *Dependency) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*d = Dependency{Name: name}
+		return nil
+	}
+	var obj dependencyObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*d = Dependency(obj)
+	return nil
+}
+
+func (d Dependency) isPlain() bool {
+	return d.Platform == "" && !d.Host && len(d.Features) == 0 && d.DefaultFeatures == nil
+}
+
+// UsesDefaultFeatures reports whether the edge turns on the default features of its target
+func (d Dependency) UsesDefaultFeatures() bool {
+	return d.DefaultFeatures == nil || *d.DefaultFeatures
+}
+
+// key identifies an edge with all of its qualifiers, for diffing dependency sets
+func (d Dependency) key() string {
+	return schema.Dependency(d).Key()
+}
+
+// filterDependencies keeps the edges whose platform expression holds for the identifiers
+func filterDependencies(deps []Dependency, identifiers map[string]bool) []Dependency {
+	var kept []Dependency
+	for _, dep := range deps {
+		if ok, err := evalPlatform(dep.Platform, identifiers); err == nil && ok {
+			kept = append(kept, dep)
+		}
+	}
+	return kept
+}
+
+// forTriplet narrows the package's edges to those that apply to the identifiers
+func (pkg *Package) forTriplet(identifiers map[string]bool) {
+	pkg.Dependencies = filterDependencies(pkg.Dependencies, identifiers)
+	pkg.DefaultFeatures = filterDefaultFeatures(pkg.DefaultFeatures, identifiers)
+	for name, feat := range pkg.Features {
+		feat.Dependencies = filterDependencies(feat.Dependencies, identifiers)
+		feat.RequiredFeatures = filterFeatureRequirements(feat.RequiredFeatures, identifiers)
+		pkg.Features[name] = feat
+	}
+}
+
+// DefaultFeature is a feature enabled unless a dependent opts out with
+// "default-features": false. Like Dependency it encodes as a plain name when
+// it applies on every platform.
+type DefaultFeature struct {
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+}
+
+type defaultFeatureObject DefaultFeature
+
+func (f DefaultFeature) MarshalJSON() ([]byte, error) {
+	if f.Platform == "" {
+		return json.Marshal(f.Name)
+	}
+	return json.Marshal(defaultFeatureObject(f))
+}
+
+func (f *DefaultFeature) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*f = DefaultFeature{Name: name}
+		return nil
+	}
+	var obj defaultFeatureObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*f = DefaultFeature(obj)
+	return nil
+}
+
+// diffSet returns the entries of desired missing from current, and the
+// entries of current missing from desired
+func diffSet[T comparable](current, desired []T) (added, removed []T) {
+	have := make(map[T]bool, len(current))
+	for _, f := range current {
+		have[f] = true
+	}
+	want := make(map[T]bool, len(desired))
+	for _, f := range desired {
+		if !want[f] && !have[f] {
+			added = append(added, f)
+		}
+		want[f] = true
+	}
+	for _, f := range current {
+		if !want[f] {
+			removed = append(removed, f)
+			want[f] = true
+		}
+	}
+	return added, removed
+}
+
+// filterDefaultFeatures keeps the default features that apply to the identifiers
+func filterDefaultFeatures(features []DefaultFeature, identifiers map[string]bool) []DefaultFeature {
+	var kept []DefaultFeature
+	for _, f := range features {
+		if ok, err := evalPlatform(f.Platform, identifiers); err == nil && ok {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// FeatureRequirement is a feature that must be enabled along with another one.
+// Package is empty for features of the same package. The string form is
+// "feat" or "pkg[feat]", the object form is used when it has a platform.
+type FeatureRequirement struct {
+	Package  string `json:"package,omitempty"`
+	Feature  string `json:"feature"`
+	Platform string `json:"platform,omitempty"`
+}
+
+type featureRequirementObject FeatureRequirement
+
+func (r FeatureRequirement) String() string {
+	if r.Package == "" {
+		return r.Feature
+	}
+	return r.Package + "[" + r.Feature + "]"
+}
+
+func (r FeatureRequirement) MarshalJSON() ([]byte, error) {
+	if r.Platform == "" {
+		return json.Marshal(r.String())
+	}
+	return json.Marshal(featureRequirementObject(r))
+}
+
+func (r *FeatureRequirement) UnmarshalJSON(data []byte) error {
+	var ref string
+	if err := json.Unmarshal(data, &ref); err == nil {
+		*r = parseFeatureRequirement(ref)
+		return nil
+	}
+	var obj featureRequirementObject
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*r = FeatureRequirement(obj)
+	return nil
+}
+
+// parseFeatureRequirement reads the "feat" or "pkg[feat]" form
+func parseFeatureRequirement(ref string) FeatureRequirement {
+	if name, rest, found := strings.Cut(ref, "["); found {
+		return FeatureRequirement{Package: name, Feature: strings.TrimSuffix(rest, "]")}
+	}
+	return FeatureRequirement{Feature: ref}
+}
+
+// featureRequirements returns the requirements of a feature of owner: the
+// explicit ones plus the features its dependencies turn on in other packages.
+// Requirements on owner itself are normalized to an empty Package.
+func featureRequirements(owner string, feat Feature) []FeatureRequirement {
+	var requirements []FeatureRequirement
+	seen := make(map[FeatureRequirement]bool)
+	add := func(req FeatureRequirement) {
+		if req.Package == owner {
+			req.Package = ""
+		}
+		if req.Feature == "" || req.Feature == "core" || seen[req] {
+			return
+		}
+		seen[req] = true
+		requirements = append(requirements, req)
+	}
+	for _, req := range feat.RequiredFeatures {
+		add(req)
+	}
+	for _, dep := range feat.Dependencies {
+		for _, f := range dep.Features {
+			add(FeatureRequirement{Package: dep.Name, Feature: f, Platform: dep.Platform})
+		}
+	}
+	return requirements
+}
+
+// filterFeatureRequirements keeps the requirements that apply to the identifiers
+func filterFeatureRequirements(requirements []FeatureRequirement, identifiers map[string]bool) []FeatureRequirement {
+	var kept []FeatureRequirement
+	for _, req := range requirements {
+		if ok, err := evalPlatform(req.Platform, identifiers); err == nil && ok {
+			kept = append(kept, req)
+		}
+	}
+	return kept
+}
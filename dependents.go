@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+)
+
+const (
+	dependentCore    = "core"
+	dependentFeature = "feature"
+)
+
+// DependentEdge is a dependency of From on To. Kind is "core" when From depends
+// on To unconditionally and "feature" when only some of its features do.
+type DependentEdge struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Kind     string   `json:"kind"`
+	Features []string `json:"features,omitempty"`
+}
+
+// Dependent is a package that depends on the requested one
+type Dependent struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Features []string `json:"features,omitempty"`
+	Depth    int      `json:"depth"`
+	Paths    int64    `json:"paths"`
+}
+
+// DependentsResponse is the response body of /package/dependents
+type DependentsResponse struct {
+	Name       string          `json:"name"`
+	Transitive bool            `json:"transitive"`
+	Dependents []Dependent     `json:"dependents"`
+	Edges      []DependentEdge `json:"edges"`
+}
+
+// addReverseEdge records that from depends on to, through feature or, when
+// feature is empty, unconditionally
+func addReverseEdge(reverse map[string]map[string]*DependentEdge, from, to, feature string) {
+	if from == to {
+		return
+	}
+	if reverse[to] == nil {
+		reverse[to] = make(map[string]*DependentEdge)
+	}
+	edge := reverse[to][from]
+	if edge == nil {
+		edge = &DependentEdge{From: from, To: to, Kind: dependentFeature}
+		reverse[to][from] = edge
+	}
+	if feature == "" {
+		edge.Kind = dependentCore
+	} else {
+		edge.Features = append(edge.Features, feature)
+	}
+}
+
+// findDependents walks the reverse graph from name. Depth is the length of the
+// shortest path; Paths counts the paths back to name, with every dependency
+// cycle counted as one node.
+func findDependents(name string, transitive bool) (DependentsResponse, error) {
+	response := DependentsResponse{Name: name, Transitive: transitive, Dependents: []Dependent{}, Edges: []DependentEdge{}}
+
+	reverse, err := store.ReverseEdges()
+	if err != nil {
+		return response, err
+	}
+
+	// Breadth-first search gives the depth of every dependent
+	depth := map[string]int{name: 0}
+	queue := []string{name}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if !transitive && current != name {
+			continue
+		}
+		for from, edge := range reverse[current] {
+			response.Edges = append(response.Edges, *edge)
+			if _, seen := depth[from]; !seen {
+				depth[from] = depth[current] + 1
+				queue = append(queue, from)
+			}
+		}
+	}
+
+	// A dependent is "core" if it reaches name through core edges only
+	coreReachable := map[string]bool{name: true}
+	queue = []string{name}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if !transitive && current != name {
+			continue
+		}
+		for from, edge := range reverse[current] {
+			if edge.Kind == dependentCore && !coreReachable[from] {
+				coreReachable[from] = true
+				queue = append(queue, from)
+			}
+		}
+	}
+
+	paths := countPathsTo(name, reverse, transitive)
+
+	for dependent, d := range depth {
+		if dependent == name {
+			continue
+		}
+		entry := Dependent{Name: dependent, Kind: dependentFeature, Depth: d, Paths: paths[dependent]}
+		if coreReachable[dependent] {
+			entry.Kind = dependentCore
+		}
+		if direct := reverse[name][dependent]; direct != nil {
+			entry.Features = direct.Features
+		}
+		response.Dependents = append(response.Dependents, entry)
+	}
+
+	sort.Slice(response.Dependents, func(i, j int) bool {
+		a, b := response.Dependents[i], response.Dependents[j]
+		if a.Depth != b.Depth {
+			return a.Depth < b.Depth
+		}
+		return a.Name < b.Name
+	})
+	sort.Slice(response.Edges, func(i, j int) bool {
+		a, b := response.Edges[i], response.Edges[j]
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.From < b.From
+	})
+	return response, nil
+}
+
+// countPathsTo counts, for each package, the paths leading to target once
+// every dependency cycle is collapsed into a single node, so the counts do not
+// depend on where a walk enters a cycle. Counts saturate instead of overflowing.
+func countPathsTo(target string, reverse map[string]map[string]*DependentEdge, transitive bool) map[string]int64 {
+	paths := map[string]int64{}
+	if !transitive {
+		for from := range reverse[target] {
+			paths[from] = 1
+		}
+		return paths
+	}
+
+	forward := make(map[string][]string)
+	for to, dependents := range reverse {
+		for from := range dependents {
+			forward[from] = append(forward[from], to)
+		}
+	}
+	component := stronglyConnected(forward)
+
+	// Edges between components, each counted once
+	successors := make(map[int]map[int]bool)
+	for from, tos := range forward {
+		for _, to := range tos {
+			if component[from] == component[to] {
+				continue
+			}
+			if successors[component[from]] == nil {
+				successors[component[from]] = make(map[int]bool)
+			}
+			successors[component[from]][component[to]] = true
+		}
+	}
+
+	targetComponent, ok := component[target]
+	if !ok {
+		return paths
+	}
+	counts := map[int]int64{targetComponent: 1}
+	var count func(int) int64
+	count = func(c int) int64 {
+		if n, ok := counts[c]; ok {
+			return n
+		}
+		var total int64
+		for next := range successors[c] {
+			n := count(next)
+			if total > math.MaxInt64-n {
+				total = math.MaxInt64
+			} else {
+				total += n
+			}
+		}
+		counts[c] = total
+		return total
+	}
+
+	for name, c := range component {
+		if name != target {
+			paths[name] = count(c)
+		}
+	}
+	return paths
+}
+
+// stronglyConnected numbers the strongly connected components of graph with
+// Tarjan's algorithm; packages in one dependency cycle share a number
+func stronglyConnected(graph map[string][]string) map[string]int {
+	index := map[string]int{}
+	lowlink := map[string]int{}
+	onStack := map[string]bool{}
+	component := map[string]int{}
+	var stack []string
+	components := 0
+
+	var visit func(string)
+	visit = func(name string) {
+		index[name] = len(index)
+		lowlink[name] = index[name]
+		stack = append(stack, name)
+		onStack[name] = true
+		for _, next := range graph[name] {
+			if _, seen := index[next]; !seen {
+				visit(next)
+				lowlink[name] = min(lowlink[name], lowlink[next])
+			} else if onStack[next] {
+				lowlink[name] = min(lowlink[name], index[next])
+			}
+		}
+		if lowlink[name] != index[name] {
+			return
+		}
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component[top] = components
+			if top == name {
+				break
+			}
+		}
+		components++
+	}
+
+	for name, nexts := range graph {
+		if _, seen := index[name]; !seen {
+			visit(name)
+		}
+		for _, next := range nexts {
+			if _, seen := index[next]; !seen {
+				visit(next)
+			}
+		}
+	}
+	return component
+}
+
+func getPackageDependents(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("name")
+	if packageName == "" {
+		http.Error(w, "Missing package name", http.StatusBadRequest)
+		return
+	}
+	transitive := r.URL.Query().Get("transitive") == "true"
+
+	response, err := findDependents(packageName, transitive)
+	if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func reverseGraph(edges [][3]string) map[string]map[string]*DependentEdge {
+	reverse := make(map[string]map[string]*DependentEdge)
+	for _, e := range edges {
+		addReverseEdge(reverse, e[0], e[1], e[2])
+	}
+	return reverse
+}
+
+func TestCountPathsToDiamond(t *testing.T) {
+	reverse := reverseGraph([][3]string{
+		{"b", "t", ""},
+		{"c", "t", ""},
+		{"d", "b", ""},
+		{"d", "c", "extra"},
+		{"e", "d", ""},
+	})
+	paths := countPathsTo("t", reverse, true)
+	want := map[string]int64{"b": 1, "c": 1, "d": 2, "e": 2}
+	for name, n := range want {
+		if paths[name] != n {
+			t.Errorf("paths[%s] = %d, want %d", name, paths[name], n)
+		}
+	}
+}
+
+func TestCountPathsToCycle(t *testing.T) {
+	// a and b depend on each other, like freetype[harfbuzz] and harfbuzz
+	reverse := reverseGraph([][3]string{
+		{"a", "t", ""},
+		{"b", "a", ""},
+		{"a", "b", "cycle"},
+		{"c", "b", ""},
+	})
+	want := map[string]int64{"a": 1, "b": 1, "c": 1}
+	// Map iteration order differs between runs, the counts must not
+	for run := 0; run < 200; run++ {
+		paths := countPathsTo("t", reverse, true)
+		for name, n := range want {
+			if paths[name] != n {
+				t.Fatalf("run %d: paths[%s] = %d, want %d", run, name, paths[name], n)
+			}
+		}
+	}
+}
+
+func TestCountPathsToCycleThroughTarget(t *testing.T) {
+	reverse := reverseGraph([][3]string{
+		{"a", "t", ""},
+		{"t", "a", "cycle"},
+		{"b", "a", ""},
+		{"b", "t", ""},
+	})
+	paths := countPathsTo("t", reverse, true)
+	if paths["a"] != 1 || paths["b"] != 1 {
+		t.Errorf("paths = %v, want a and b at 1", paths)
+	}
+}
+
+func TestCountPathsToDirect(t *testing.T) {
+	reverse := reverseGraph([][3]string{
+		{"a", "t", ""},
+		{"b", "a", ""},
+	})
+	paths := countPathsTo("t", reverse, false)
+	if paths["a"] != 1 || paths["b"] != 0 {
+		t.Errorf("paths = %v, want only a", paths)
+	}
+}
@@ -2,10 +2,13 @@ module github.com/frate-packages/package-server
 
 go 1.23.1
 
-require github.com/mattn/go-sqlite3 v1.14.24
+require (
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/redis/go-redis/v9 v9.7.0
+)
 
 require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
-	github.com/redis/go-redis/v9 v9.7.0 // indirect
 )
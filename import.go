@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/frate-packages/package-server/schema"
+)
+
+const importUsage = `usage: package-server import <sqlite file>
+
+Copies the index of a SQLite file written by ingest into the database
+selected by DATABASE_DRIVER and DATABASE_URL, replacing what it holds. Both
+schemas must be current, run the migrate command on the target first.
+Restart the servers using the target, or flush their cache, afterwards.`
+
+// runImport implements the import command and returns the exit code. Ingest
+// only writes SQLite, this is how its output gets into PostgreSQL.
+func runImport(args []string) int {
+	if len(args) != 1 {
+		fmt.Println(importUsage)
+		return 2
+	}
+
+	var d dialect
+	switch databaseDriver {
+	case "sqlite3":
+		d = sqliteDialect
+	case "postgres":
+		d = postgresDialect
+	default:
+		fmt.Printf("cannot import into the %s driver, expected sqlite3 or postgres\n", databaseDriver)
+		return 2
+	}
+	set, err := schema.For(databaseDriver)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	source, err := openCurrent("sqlite3", args[0], schema.SQLite)
+	if err != nil {
+		fmt.Printf("Failed to open %s: %v\n", args[0], err)
+		return 1
+	}
+	defer source.Close()
+	target, err := openCurrent(databaseDriver, databaseURL, set)
+	if err != nil {
+		fmt.Printf("Failed to open the %s database: %v\n", databaseDriver, err)
+		return 1
+	}
+	defer target.Close()
+
+	copied, err := importTables(source, target, d)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	for _, table := range schema.Tables {
+		fmt.Printf("copied %d rows into %s\n", copied[table], table)
+	}
+	return 0
+}
+
+// openCurrent opens a database whose schema is at the latest version of set
+func openCurrent(driver, url string, set *schema.Set) (*sql.DB, error) {
+	db, err := sql.Open(driver, url)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err == nil {
+		err = set.Check(db)
+	}
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// importTables replaces the rows of target with those of source in one
+// transaction and returns how many rows each table got. Only the columns of
+// the target are copied, so ids the target generates are left to it; rows
+// are read in insertion order, which keeps the order of edited cmake targets.
+func importTables(source, target *sql.DB, d dialect) (map[string]int, error) {
+	tx, err := target.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	conn := rebound{tx, d}
+
+	for i := len(schema.Tables) - 1; i >= 0; i-- {
+		if _, err := conn.Exec("DELETE FROM " + schema.Tables[i]); err != nil {
+			return nil, fmt.Errorf("error clearing %s: %v", schema.Tables[i], err)
+		}
+	}
+
+	copied := make(map[string]int)
+	for _, table := range schema.Tables {
+		n, err := copyTable(source, conn, table)
+		if err != nil {
+			return nil, fmt.Errorf("error copying %s: %v", table, err)
+		}
+		copied[table] = n
+	}
+
+	if d == sqliteDialect {
+		if err := schema.RebuildSearchIndex(tx); err != nil {
+			return nil, fmt.Errorf("error rebuilding the search index: %v", err)
+		}
+	}
+	return copied, tx.Commit()
+}
+
+// copyTable inserts every row of table in source through conn
+func copyTable(source *sql.DB, conn sqlConn, table string) (int, error) {
+	columns, err := tableColumns(conn, table)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := source.Query("SELECT " + strings.Join(columns, ", ") + " FROM " + table + " ORDER BY rowid")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	insert := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ") + ")"
+	n := 0
+	values := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return n, err
+		}
+		if _, err := conn.Exec(insert, values...); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, rows.Err()
+}
+
+// tableColumns lists the columns of table in the target, without the id
+// PostgreSQL generates for cmake_targets
+func tableColumns(conn sqlConn, table string) ([]string, error) {
+	rows, err := conn.Query("SELECT * FROM " + table + " WHERE 1 = 0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	all, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var columns []string
+	for _, column := range all {
+		if column != "id" {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestImport copies a SQLite file written through the store into each SQL
+// backend with the import command, the way ingest output reaches them
+func TestImport(t *testing.T) {
+	source := migratedSQLite(t)
+	s, err := newSQLiteStore(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createPackages(t, s, listFixture...)
+	targets := []CMakeTarget{
+		{FindPackage: "CURL", Target: "CURL::libcurl"},
+		{Feature: "ssl", FindPackage: "OpenSSL", Target: "OpenSSL::SSL", Module: true},
+		{FindPackage: "CURL", Component: "tools", Target: "CURL::curl"},
+	}
+	if err := s.ReplaceCMakeTargets(listFixture[0].Name, targets); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	versions := make(map[string]int)
+	for _, pkg := range listFixture {
+		stored, err := s.Package(pkg.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[pkg.Name] = canonical(stored)
+		v, err := s.PackageVersions(pkg.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions[pkg.Name] = len(v)
+	}
+	s.Close()
+
+	for _, target := range []struct {
+		driver string
+		url    func(t *testing.T) string
+	}{
+		{"sqlite3", migratedSQLite},
+		{"postgres", migratedPostgres},
+	} {
+		t.Run(target.driver, func(t *testing.T) {
+			dbURL := target.url(t)
+			previousDriver, previousURL := databaseDriver, databaseURL
+			databaseDriver, databaseURL = target.driver, dbURL
+			t.Cleanup(func() { databaseDriver, databaseURL = previousDriver, previousURL })
+
+			if code := runImport([]string{source}); code != 0 {
+				t.Fatalf("import exited with %d", code)
+			}
+			imported, err := openStore(target.driver, dbURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer imported.Close()
+
+			for _, pkg := range listFixture {
+				got, err := imported.Package(pkg.Name)
+				if err != nil {
+					t.Fatalf("%s: %v", pkg.Name, err)
+				}
+				if canonical(got) != want[pkg.Name] {
+					t.Errorf("imported\n%s\nwant\n%s", canonical(got), want[pkg.Name])
+				}
+				if v, err := imported.PackageVersions(pkg.Name); err != nil || len(v) != versions[pkg.Name] {
+					t.Errorf("%s: %d versions, %v, want %d", pkg.Name, len(v), err, versions[pkg.Name])
+				}
+			}
+			got, err := imported.CMakeTargets(listFixture[0].Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, targets) {
+				t.Errorf("targets %+v, want %+v in the edited order", got, targets)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// listQuery holds the normalized parameters of a /packages request
+type listQuery struct {
+	Limit    int
+	Cursor   *listCursor
+	Sort     string
+	Order    string
+	License  string
+	MinStars int
+	Feature  string
+	Triplet  string
+
+	// tripletIDs holds the platform identifiers of Triplet
+	tripletIDs map[string]bool
+}
+
+// listCursor marks the last row of the previous page for keyset pagination
+type listCursor struct {
+	Value string `json:"v"`
+	Name  string `json:"n"`
+}
+
+// PackageList is the response body of /packages
+type PackageList struct {
+	Packages   []Package `json:"packages"`
+	Total      int       `json:"total"`
+	Count      int       `json:"count"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	Next       string    `json:"next,omitempty"`
+}
+
+// sortColumns maps the accepted sort keys to their SQL expressions
+var sortColumns = map[string]string{
+	"name":          "name",
+	"stars":         "COALESCE(stars, 0)",
+	"last_modified": "COALESCE(last_modified, '')",
+}
+
+// defaultSortOrder is used when no explicit order is requested
+var defaultSortOrder = map[string]string{
+	"name":          "asc",
+	"stars":         "desc",
+	"last_modified": "desc",
+}
+
+func parseListQuery(values url.Values) (listQuery, error) {
+	q := listQuery{
+		Limit:   defaultPageLimit,
+		Sort:    "name",
+		License: values.Get("license"),
+		Feature: values.Get("feature"),
+	}
+
+	// A substring of the supports expression also matched "!windows" for
+	// windows, the triplet filter evaluates it
+	if values.Has("supports") {
+		return q, fmt.Errorf("supports is not a filter, use triplet to list the packages a triplet supports")
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return q, fmt.Errorf("invalid limit %q", v)
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+		q.Limit = limit
+	}
+
+	if v := values.Get("sort"); v != "" {
+		if _, ok := sortColumns[v]; !ok {
+			return q, fmt.Errorf("invalid sort %q, expected name, stars or last_modified", v)
+		}
+		q.Sort = v
+	}
+
+	q.Order = defaultSortOrder[q.Sort]
+	if v := values.Get("order"); v != "" {
+		if v != "asc" && v != "desc" {
+			return q, fmt.Errorf("invalid order %q, expected asc or desc", v)
+		}
+		q.Order = v
+	}
+
+	if v := values.Get("min_stars"); v != "" {
+		minStars, err := strconv.Atoi(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid min_stars %q", v)
+		}
+		q.MinStars = minStars
+	}
+
+	if v := values.Get("triplet"); v != "" {
+		ids, err := tripletIdentifiers(v)
+		if err != nil {
+			return q, err
+		}
+		q.Triplet = strings.ToLower(v)
+		q.tripletIDs = ids
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return q, fmt.Errorf("invalid cursor")
+		}
+		if q.Sort == "stars" {
+			if _, err := strconv.Atoi(cursor.Value); err != nil {
+				return q, fmt.Errorf("cursor does not match sort %q", q.Sort)
+			}
+		}
+		q.Cursor = &cursor
+	}
+
+	return q, nil
+}
+
+func decodeCursor(s string) (listCursor, error) {
+	var c listCursor
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(raw, &c)
+	return c, err
+}
+
+func encodeCursor(c listCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// cursorFor builds the cursor pointing just past pkg in the current sort
+func (q listQuery) cursorFor(pkg Package) listCursor {
+	switch q.Sort {
+	case "stars":
+		return listCursor{Value: strconv.Itoa(pkg.Stars), Name: pkg.Name}
+	case "last_modified":
+		return listCursor{Value: pkg.LastModified, Name: pkg.Name}
+	default:
+		return listCursor{Value: pkg.Name, Name: pkg.Name}
+	}
+}
+
+// filterSQL returns the WHERE clause shared by the page and the total count
+func (q listQuery) filterSQL(d dialect) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if q.License != "" {
+		conds = append(conds, "license = ?")
+		args = append(args, q.License)
+	}
+	if q.MinStars > 0 {
+		conds = append(conds, "COALESCE(stars, 0) >= ?")
+		args = append(args, q.MinStars)
+	}
+	if q.Feature != "" {
+		conds = append(conds, "EXISTS (SELECT 1 FROM features f WHERE f.package_name = packages.name AND f.feature_name = ?)")
+		args = append(args, q.Feature)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// pageSQL returns the query for a single page, including the keyset condition
+func (q listQuery) pageSQL(d dialect) (string, []interface{}) {
+	where, args := q.filterSQL(d)
+	column := sortColumns[q.Sort]
+
+	cmp := ">"
+	if q.Order == "desc" {
+		cmp = "<"
+	}
+
+	if q.Cursor != nil {
+		var value interface{} = q.Cursor.Value
+		if q.Sort == "stars" {
+			value, _ = strconv.Atoi(q.Cursor.Value)
+		}
+
+		var cond string
+		if q.Sort == "name" {
+			cond = "name " + cmp + " ?"
+			args = append(args, q.Cursor.Name)
+		} else {
+			// Ties on the sort column are broken by name, always ascending
+			cond = fmt.Sprintf("(%s %s ? OR (%s = ? AND name > ?))", column, cmp, column)
+			args = append(args, value, value, q.Cursor.Name)
+		}
+
+		if where == "" {
+			where = " WHERE " + cond
+		} else {
+			where += " AND " + cond
+		}
+	}
+
+	order := column + " " + strings.ToUpper(q.Order)
+	if q.Sort != "name" {
+		order += ", name ASC"
+	}
+
+	query := "SELECT " + packageColumns + " FROM packages" +
+		where + " ORDER BY " + order
+	if q.Triplet != "" {
+		// Platform support is evaluated in Go, so the page is cut after filtering
+		return query, args
+	}
+	// Fetch one extra row to know whether another page exists
+	args = append(args, q.Limit+1)
+	return query + " LIMIT ?", args
+}
+
+// matches applies the filters that cannot be expressed in SQL
+func (q listQuery) matches(pkg Package) bool {
+	if q.Triplet == "" {
+		return true
+	}
+	supported, err := evalPlatform(pkg.Supports, q.tripletIDs)
+	return err == nil && supported
+}
+
+// values returns the canonical query string form, used for cache keys and links
+func (q listQuery) values() url.Values {
+	v := url.Values{}
+	v.Set("limit", strconv.Itoa(q.Limit))
+	v.Set("sort", q.Sort)
+	v.Set("order", q.Order)
+	if q.License != "" {
+		v.Set("license", q.License)
+	}
+	if q.MinStars > 0 {
+		v.Set("min_stars", strconv.Itoa(q.MinStars))
+	}
+	if q.Feature != "" {
+		v.Set("feature", q.Feature)
+	}
+	if q.Triplet != "" {
+		v.Set("triplet", q.Triplet)
+	}
+	if q.Cursor != nil {
+		v.Set("cursor", encodeCursor(*q.Cursor))
+	}
+	return v
+}
+
+// cacheKey identifies the normalized query in the cache
+func (q listQuery) cacheKey() string {
+	return packageListKeyPrefix + q.values().Encode()
+}
+
+// cacheTags lists what a page of the query depends on: the packages shown,
+// the set of packages, and the columns its filters and sort read
+func (q listQuery) cacheTags(packages []Package) []string {
+	tags := []string{cacheTagMembers}
+	for _, pkg := range packages {
+		tags = append(tags, packageTag(pkg.Name))
+	}
+	fields := map[string]bool{}
+	if q.Sort != "name" {
+		fields[q.Sort] = true
+	}
+	if q.License != "" {
+		fields["license"] = true
+	}
+	if q.Triplet != "" {
+		fields["supports"] = true
+	}
+	if q.MinStars > 0 {
+		fields["stars"] = true
+	}
+	if q.Feature != "" {
+		fields["features"] = true
+	}
+	for field := range fields {
+		tags = append(tags, listFieldTag(field))
+	}
+	return tags
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/frate-packages/package-server/semver"
+)
+
+// lockfileVersion is bumped whenever the lockfile format changes incompatibly
+const lockfileVersion = 1
+
+// LockRequest is a package asked for by a project, with an optional version
+// constraint: "1.2.3" or "=1.2.3" pins a version, ">=1.2.3" sets a minimum.
+type LockRequest struct {
+	Name            string   `json:"name"`
+	Features        []string `json:"features,omitempty"`
+	DefaultFeatures *bool    `json:"default_features,omitempty"`
+	Version         string   `json:"version,omitempty"`
+}
+
+// LockRequestBody is the body of POST /lock
+type LockRequestBody struct {
+	Triplet  string        `json:"triplet,omitempty"`
+	Packages []LockRequest `json:"packages"`
+}
+
+// LockedPackage is one node of the resolved closure, pinned to an exact version
+type LockedPackage struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	PortVersion  int      `json:"port_version,omitempty"`
+	Tag          string   `json:"tag,omitempty"`
+	GitURL       string   `json:"git_url"`
+	Commit       string   `json:"commit,omitempty"`
+	Features     []string `json:"features"`
+	Dependencies []string `json:"dependencies"`
+	Hash         string   `json:"hash"`
+}
+
+// Lockfile is the response body of POST /lock and the body of POST /lock/verify
+type Lockfile struct {
+	LockfileVersion int             `json:"lockfile_version"`
+	Triplet         string          `json:"triplet,omitempty"`
+	Requested       []LockRequest   `json:"requested"`
+	Packages        []LockedPackage `json:"packages"`
+	Hash            string          `json:"hash"`
+
+	// Diagnostics holds the resolver findings that do not prevent locking,
+	// such as build tools missing from the index
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+}
+
+// LockMismatch is a difference between a lockfile and what it should contain
+type LockMismatch struct {
+	Package string `json:"package,omitempty"`
+	Field   string `json:"field"`
+	Locked  string `json:"locked,omitempty"`
+	Current string `json:"current,omitempty"`
+	Message string `json:"message"`
+}
+
+// LockVerification is the response body of POST /lock/verify
+type LockVerification struct {
+	Valid      bool           `json:"valid"`
+	Mismatches []LockMismatch `json:"mismatches"`
+}
+
+// parseVersionConstraint splits a constraint into its operator and version
+func parseVersionConstraint(constraint string) (string, string, error) {
+	switch {
+	case constraint == "":
+		return "", "", nil
+	case strings.HasPrefix(constraint, ">="):
+		return ">=", strings.TrimSpace(constraint[2:]), nil
+	case strings.HasPrefix(constraint, "="):
+		return "=", strings.TrimSpace(constraint[1:]), nil
+	case strings.ContainsAny(constraint, "<>~^"):
+		return "", "", fmt.Errorf("unsupported version constraint %q, expected \"1.2.3\", \"=1.2.3\" or \">=1.2.3\"", constraint)
+	default:
+		return "=", strings.TrimSpace(constraint), nil
+	}
+}
+
+// pin makes the resolver use the snapshot of name at version instead of the current one
+func (res *resolver) pin(name, version string) error {
+	pkg, err := fetchPackageVersion(name, version)
+	if err != nil {
+		return err
+	}
+	res.packages[name] = &resolvePackage{
+		Version:         pkg.Version,
+		PortVersion:     pkg.PortVersion,
+		Supports:        pkg.Supports,
+		Dependencies:    pkg.Dependencies,
+		Features:        pkg.Features,
+		DefaultFeatures: pkg.DefaultFeatures,
+	}
+	return nil
+}
+
+// buildLockfile resolves the requested packages and pins every node of the closure
+func buildLockfile(body LockRequestBody) (Lockfile, error) {
+	if len(body.Packages) == 0 {
+		return Lockfile{}, &requestError{http.StatusBadRequest, "No packages requested"}
+	}
+
+	res, err := newResolver(body.Triplet)
+	if err != nil {
+		return Lockfile{}, &requestError{http.StatusBadRequest, err.Error()}
+	}
+
+	var requests []resolveRequest
+	var problems []string
+	for _, req := range body.Packages {
+		if req.Name == "" {
+			return Lockfile{}, &requestError{http.StatusBadRequest, "Missing package name"}
+		}
+		op, version, err := parseVersionConstraint(req.Version)
+		if err != nil {
+			return Lockfile{}, &requestError{http.StatusBadRequest, err.Error()}
+		}
+		switch op {
+		case "=":
+			if err := res.pin(req.Name, version); err == ErrNotFound {
+				problems = append(problems, "no version "+version+" of "+req.Name)
+			} else if err == ErrManifestUnknown {
+				problems = append(problems, "version "+version+" of "+req.Name+": "+err.Error())
+			} else if err != nil {
+				return Lockfile{}, err
+			}
+		case ">=":
+			pkg, err := res.loadPackage(req.Name)
+			if err != nil {
+				return Lockfile{}, err
+			}
+			if pkg != nil && semver.Compare(pkg.Version, version) < 0 {
+				problems = append(problems, req.Name+" "+pkg.Version+" does not satisfy >="+version)
+			}
+		}
+		requests = append(requests, resolveRequest{
+			Name:            req.Name,
+			Features:        req.Features,
+			DefaultFeatures: req.DefaultFeatures == nil || *req.DefaultFeatures,
+		})
+	}
+
+	resolution, err := res.resolve(requests)
+	if err != nil {
+		return Lockfile{}, err
+	}
+	var diagnostics []Diagnostic
+	for _, diag := range resolution.Diagnostics {
+		if diag.Type == "missing_feature" || (diag.Type == "missing_package" && diag.RequiredBy == "") {
+			problems = append(problems, diag.Message)
+		} else {
+			diagnostics = append(diagnostics, diag)
+		}
+	}
+	if len(problems) > 0 {
+		return Lockfile{}, &requestError{http.StatusUnprocessableEntity, "Cannot lock: " + strings.Join(problems, "; ")}
+	}
+
+	dependencies := make(map[string]map[string]bool)
+	for _, edge := range resolution.Edges {
+		if edge.From == edge.To {
+			continue
+		}
+		if dependencies[edge.From] == nil {
+			dependencies[edge.From] = make(map[string]bool)
+		}
+		dependencies[edge.From][edge.To] = true
+	}
+
+	lock := Lockfile{
+		LockfileVersion: lockfileVersion,
+		Triplet:         res.triplet,
+		Requested:       body.Packages,
+		Packages:        []LockedPackage{},
+		Diagnostics:     diagnostics,
+	}
+	for _, node := range resolution.Nodes {
+		locked := LockedPackage{
+			Name:         node.Name,
+			Version:      node.Version,
+			PortVersion:  node.PortVersion,
+			Features:     node.Features,
+			Dependencies: []string{},
+		}
+		for dep := range dependencies[node.Name] {
+			locked.Dependencies = append(locked.Dependencies, dep)
+		}
+		sort.Strings(locked.Dependencies)
+
+		pkg, err := store.Package(node.Name)
+		if err != nil {
+			return Lockfile{}, err
+		}
+		locked.GitURL = pkg.GitURL
+		version, err := store.PackageVersion(node.Name, node.Version)
+		if err != nil && err != ErrNotFound {
+			return Lockfile{}, err
+		}
+		locked.Tag = version.Tag
+		locked.Commit = version.Commit
+
+		locked.Hash = locked.contentHash()
+		lock.Packages = append(lock.Packages, locked)
+	}
+	lock.Hash = lock.contentHash()
+	return lock, nil
+}
+
+// contentHash hashes everything about the node except the hash itself
+func (p LockedPackage) contentHash() string {
+	p.Hash = ""
+	return hashJSON(p)
+}
+
+// contentHash covers the format version, the request and every node hash
+func (l Lockfile) contentHash() string {
+	nodes := make([]string, len(l.Packages))
+	for i, p := range l.Packages {
+		nodes[i] = p.Name + "@" + p.Hash
+	}
+	return hashJSON(struct {
+		LockfileVersion int           `json:"lockfile_version"`
+		Triplet         string        `json:"triplet"`
+		Requested       []LockRequest `json:"requested"`
+		Packages        []string      `json:"packages"`
+	}{l.LockfileVersion, l.Triplet, l.Requested, nodes})
+}
+
+func hashJSON(v interface{}) string {
+	raw, _ := json.Marshal(v)
+	sum := sha256.Sum256(raw)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// verifyLockfile checks the lockfile's hashes and compares it against a fresh resolution
+func verifyLockfile(lock Lockfile) (LockVerification, error) {
+	var mismatches []LockMismatch
+
+	for _, p := range lock.Packages {
+		if hash := p.contentHash(); hash != p.Hash {
+			mismatches = append(mismatches, LockMismatch{Package: p.Name, Field: "hash", Locked: p.Hash, Current: hash, Message: "entry for " + p.Name + " was modified"})
+		}
+	}
+	if hash := lock.contentHash(); hash != lock.Hash {
+		mismatches = append(mismatches, LockMismatch{Field: "hash", Locked: lock.Hash, Current: hash, Message: "lockfile was modified"})
+	}
+
+	fresh, err := buildLockfile(LockRequestBody{Triplet: lock.Triplet, Packages: lock.Requested})
+	if rerr, ok := err.(*requestError); ok {
+		mismatches = append(mismatches, LockMismatch{Field: "requested", Message: rerr.message})
+		return LockVerification{Mismatches: mismatches}, nil
+	} else if err != nil {
+		return LockVerification{}, err
+	}
+
+	current := make(map[string]LockedPackage, len(fresh.Packages))
+	for _, p := range fresh.Packages {
+		current[p.Name] = p
+	}
+	for _, locked := range lock.Packages {
+		p, ok := current[locked.Name]
+		if !ok {
+			mismatches = append(mismatches, LockMismatch{Package: locked.Name, Field: "package", Message: locked.Name + " is no longer part of the closure"})
+			continue
+		}
+		delete(current, locked.Name)
+		mismatches = append(mismatches, diffLockedPackage(locked, p)...)
+	}
+	var added []string
+	for name := range current {
+		added = append(added, name)
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		mismatches = append(mismatches, LockMismatch{Package: name, Field: "package", Message: name + " is missing from the lockfile"})
+	}
+
+	if mismatches == nil {
+		mismatches = []LockMismatch{}
+	}
+	return LockVerification{Valid: len(mismatches) == 0, Mismatches: mismatches}, nil
+}
+
+// diffLockedPackage lists the fields of a locked node that no longer match
+func diffLockedPackage(locked, current LockedPackage) []LockMismatch {
+	var mismatches []LockMismatch
+	compare := func(field, a, b string) {
+		if a != b {
+			mismatches = append(mismatches, LockMismatch{Package: locked.Name, Field: field, Locked: a, Current: b, Message: locked.Name + " " + field + " changed"})
+		}
+	}
+	compare("version", locked.Version, current.Version)
+	compare("port_version", fmt.Sprint(locked.PortVersion), fmt.Sprint(current.PortVersion))
+	compare("tag", locked.Tag, current.Tag)
+	compare("git_url", locked.GitURL, current.GitURL)
+	compare("commit", locked.Commit, current.Commit)
+	compare("features", strings.Join(locked.Features, ","), strings.Join(current.Features, ","))
+	compare("dependencies", strings.Join(locked.Dependencies, ","), strings.Join(current.Dependencies, ","))
+	return mismatches
+}
+
+func lockPackages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body LockRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	lock, err := buildLockfile(body)
+	if rerr, ok := err.(*requestError); ok {
+		http.Error(w, rerr.message, rerr.status)
+		return
+	} else if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lock)
+}
+
+func verifyLock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var lock Lockfile
+	if err := json.NewDecoder(r.Body).Decode(&lock); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if lock.LockfileVersion != lockfileVersion {
+		http.Error(w, fmt.Sprintf("Unsupported lockfile_version %d, expected %d", lock.LockfileVersion, lockfileVersion), http.StatusBadRequest)
+		return
+	}
+
+	verification, err := verifyLockfile(lock)
+	if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(verification)
+}
@@ -1,261 +1,209 @@
 package main
 
 import (
-	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
-	"github.com/redis/go-redis/v9"
 )
 
 type Feature struct {
-	Description      string   `json:"description"`
-	RequiredFeatures []string `json:"required_features,omitempty"`
-	Dependencies     []string `json:"dependencies,omitempty"`
-}
-
-type Package struct {
-	Name         string             `json:"name"`
-	Version      string             `json:"version"`
-	Description  string             `json:"description"`
-	GitURL       string             `json:"git_url"`
-	License      string             `json:"license,omitempty"`
-	Supports     string             `json:"supports,omitempty"`
-	Stars        int                `json:"stars,omitempty"`
-	LastModified string             `json:"last_modified,omitempty"`
-	CMakeTarget  string             `json:"cmake_target,omitempty"`
-	Dependencies []string           `json:"dependencies"`
-	Features     map[string]Feature `json:"features,omitempty"`
+	Description      string               `json:"description"`
+	RequiredFeatures []FeatureRequirement `json:"required_features,omitempty"`
+	Dependencies     []Dependency         `json:"dependencies,omitempty"`
+	Supports         string               `json:"supports,omitempty"`
 }
 
-var db *sql.DB
-var ctx = context.Background()
-
-
-
-var redisClient *redis.Client
+// repositoryFromAPI marks a git_url set through the API rather than derived by ingest
+const repositoryFromAPI = "api"
 
-func initRedis() *redis.Client { 
-	// Read Redis host and port from environment variables
-	redisHost := os.Getenv("REDIS_HOST")
-	if redisHost == "" {
-		redisHost = "localhost" // Fallback to localhost if not set
-	}
-
-	redisPort := os.Getenv("REDIS_PORT")
-	if redisPort == "" {
-		redisPort = "6379" // Fallback to default Redis port if not set
-	}
-
-	// Construct Redis address
-	redisAddr := redisHost + ":" + redisPort
-
-	// Initialize Redis client
-	redisClient := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-	return redisClient 
+type Package struct {
+	Name             string             `json:"name"`
+	Version          string             `json:"version"`
+	PortVersion      int                `json:"port_version,omitempty"`
+	Description      string             `json:"description"`
+	Homepage         string             `json:"homepage,omitempty"`
+	GitURL           string             `json:"git_url"`
+	RepositorySource string             `json:"repository_source,omitempty"`
+	License          string             `json:"license,omitempty"`
+	Supports         string             `json:"supports,omitempty"`
+	Stars            int                `json:"stars,omitempty"`
+	LastModified     string             `json:"last_modified,omitempty"`
+	CMakeTarget      string             `json:"cmake_target,omitempty"`
+	Dependencies     []Dependency       `json:"dependencies"`
+	Features         map[string]Feature `json:"features,omitempty"`
+	DefaultFeatures  []DefaultFeature   `json:"default_features,omitempty"`
 }
 
+var databaseURL = "./data.sql"
+var databaseDriver = "sqlite3"
+var cacheDriver = "redis"
+var cacheSize = 1000
 
+// Prefixes of the cache keys of each cached endpoint
+const (
+	packageListKeyPrefix = "packages:list:"
+	packageKeyPrefix     = "package:"
+	resolveKeyPrefix     = "resolve:"
+)
 
 func init() {
-	var err error
-	var databaseURL string = "./data.sql"
-	var databaseDriver string = "sqlite3"
 	if os.Getenv("DATABASE_URL") != "" {
 		databaseURL = os.Getenv("DATABASE_URL")
 	}
 	if os.Getenv("DATABASE_DRIVER") != "" {
 		databaseDriver = os.Getenv("DATABASE_DRIVER")
 	}
-	db, err = sql.Open(databaseDriver, databaseURL)
-	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err)
+	if os.Getenv("CACHE_DRIVER") != "" {
+		cacheDriver = os.Getenv("CACHE_DRIVER")
 	}
-
-	redisClient = initRedis() 
-	_, err = redisClient.Ping(ctx).Result()
-	if err != nil {
-		fmt.Println("Failed to connect to Redis: %v", err)
-		log.Fatalf("Failed to connect to Redis: %v", err)
+	if size, err := strconv.Atoi(os.Getenv("CACHE_SIZE")); err == nil && size > 0 {
+		cacheSize = size
 	}
 }
 
 func listPackages(w http.ResponseWriter, r *http.Request) {
-	// Check Redis first
-	cachedList, err := redisClient.Get(ctx, "all_packages").Result()
-	if err == nil {
-		// Cache hit: Deserialize and return the cached list
-		var packages []Package
-		if json.Unmarshal([]byte(cachedList), &packages) == nil {
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(packages)
-			return
-		}
+	query, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check the cache first
+	cacheKey := query.cacheKey()
+	var list PackageList
+	if cacheGet(cacheKey, &list) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+		return
 	}
 
-	// Cache miss: Fetch from SQLite
-	rows, err := db.Query("SELECT name, version, description, git_url, license, supports, stars, last_modified, cmake_target FROM packages")
+	// Cache miss: Fetch from the store
+	generation := cache.Generation()
+	packages, total, err := store.ListPackages(query)
 	if err != nil {
 		http.Error(w, "Error querying database", http.StatusInternalServerError)
 		return
 	}
-	defer rows.Close()
+	list.Total = total
+
+	// The extra row only tells us that a next page exists
+	if len(packages) > query.Limit {
+		packages = packages[:query.Limit]
+		next := query
+		cursor := query.cursorFor(packages[len(packages)-1])
+		next.Cursor = &cursor
+		list.NextCursor = encodeCursor(cursor)
+		list.Next = "/packages?" + next.values().Encode()
+	}
 
-	var packages []Package
-	for rows.Next() {
-		var pkg Package
-		err := rows.Scan(&pkg.Name, &pkg.Version, &pkg.Description, &pkg.GitURL, &pkg.License, &pkg.Supports, &pkg.Stars, &pkg.LastModified, &pkg.CMakeTarget)
-		if err != nil {
-			http.Error(w, "Error scanning package row", http.StatusInternalServerError)
-			return
+	if query.Triplet != "" {
+		for i := range packages {
+			packages[i].forTriplet(query.tripletIDs)
 		}
-
-		// Add dependencies and features to each package
-		pkg.Dependencies = getPackageDependencies(pkg.Name)
-		pkg.Features = getPackageFeatures(pkg.Name)
-		packages = append(packages, pkg)
 	}
+	list.Packages = packages
+	list.Count = len(packages)
 
-	// Cache the list of packages in Redis
-	serializedPackages, _ := json.Marshal(packages)
-	redisClient.Set(ctx, "all_packages", serializedPackages, 10*time.Minute) // Cache expires in 10 minutes
+	// Cache the page under the normalized query
+	cachePut(cacheKey, list, query.cacheTags(packages), generation)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(packages)
+	json.NewEncoder(w).Encode(list)
 }
 
-func getPackageDependencies(packageName string) []string {
-	var dependencies []string
-	rows, err := db.Query("SELECT dependency_name FROM dependencies WHERE package_name = ?", packageName)
-	if err != nil {
-		return dependencies
+// reservedPackageNames are the fixed routes under /packages/, which take
+// precedence over /packages/{name} and would make such a package impossible
+// to update
+var reservedPackageNames = map[string]bool{"create": true, "delete": true, "search": true}
+
+func createPackage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var dependency string
-		if err := rows.Scan(&dependency); err == nil {
-			dependencies = append(dependencies, dependency)
-		}
+	var pkg Package
+	if err := json.NewDecoder(r.Body).Decode(&pkg); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
 	}
-	return dependencies
-}
 
-func getPackageFeatures(packageName string) map[string]Feature {
-	features := make(map[string]Feature)
-	rows, err := db.Query("SELECT feature_name, description FROM features WHERE package_name = ?", packageName)
-	if err != nil {
-		return features
+	if pkg.Name == "" {
+		http.Error(w, "Missing package name", http.StatusBadRequest)
+		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var featureName, description string
-		if err := rows.Scan(&featureName, &description); err == nil {
-			features[featureName] = Feature{
-				Description:      description,
-				Dependencies:     getFeatureDependencies(packageName, featureName),
-				RequiredFeatures: []string{},
-			}
-		}
+	if reservedPackageNames[pkg.Name] {
+		http.Error(w, "Package name "+pkg.Name+" is reserved", http.StatusBadRequest)
+		return
 	}
-	return features
-}
 
-func getFeatureDependencies(packageName, featureName string) []string {
-	var dependencies []string
-	rows, err := db.Query("SELECT dependency_name FROM feature_dependencies WHERE package_name = ? AND feature_name = ?", packageName, featureName)
+	exists, err := store.PackageExists(pkg.Name)
 	if err != nil {
-		return dependencies
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var dependency string
-		if err := rows.Scan(&dependency); err == nil {
-			dependencies = append(dependencies, dependency)
-		}
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
 	}
-	return dependencies
-}
-
-func createPackage(w http.ResponseWriter, r *http.Request) {
-	var pkg Package
-	if err := json.NewDecoder(r.Body).Decode(&pkg); err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+	if exists {
+		http.Error(w, "Package already exists", http.StatusConflict)
 		return
 	}
 
 	pkg.LastModified = time.Now().UTC().String()
-	_, err := db.Exec(`INSERT INTO packages (name, version, description, git_url, license, supports, stars, last_modified, cmake_target)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		pkg.Name, pkg.Version, pkg.Description, pkg.GitURL, pkg.License, pkg.Supports, pkg.Stars, pkg.LastModified, pkg.CMakeTarget)
-	if err != nil {
+	if pkg.GitURL != "" {
+		pkg.RepositorySource = repositoryFromAPI
+	}
+	if err := store.CreatePackage(pkg); err == ErrWriteUnavailable {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		http.Error(w, "Error inserting package", http.StatusInternalServerError)
 		return
 	}
 
-	insertDependencies(pkg.Name, pkg.Dependencies)
-	insertFeatures(pkg.Name, pkg.Features)
-
-	// Invalidate Redis cache for the entire package list
-	redisClient.Del(ctx, "all_packages")
+	// Drop the list pages the package may now appear on, and the
+	// resolutions that found it missing
+	cache.Invalidate(cacheTagMembers, packageTag(pkg.Name))
 
 	w.WriteHeader(http.StatusCreated)
 }
 
-func insertDependencies(packageName string, dependencies []string) {
-	for _, dep := range dependencies {
-		_, err := db.Exec("INSERT INTO dependencies (package_name, dependency_name) VALUES (?, ?)", packageName, dep)
-		if err != nil {
-			log.Printf("Error inserting dependency %s for package %s: %v", dep, packageName, err)
-		}
-	}
+// requestError is a problem with the request itself rather than the server,
+// reported to the client with its status and message
+type requestError struct {
+	status  int
+	message string
 }
 
-func insertFeatures(packageName string, features map[string]Feature) {
-	for featName, feat := range features {
-		_, err := db.Exec("INSERT INTO features (package_name, feature_name, description) VALUES (?, ?, ?)", packageName, featName, feat.Description)
-		if err != nil {
-			log.Printf("Error inserting feature %s for package %s: %v", featName, packageName, err)
-			continue
-		}
+func (e *requestError) Error() string { return e.message }
 
-		for _, dep := range feat.Dependencies {
-			_, err := db.Exec("INSERT INTO feature_dependencies (package_name, feature_name, dependency_name) VALUES (?, ?, ?)", packageName, featName, dep)
-			if err != nil {
-				log.Printf("Error inserting feature dependency %s for feature %s in package %s: %v", dep, featName, packageName, err)
-			}
-		}
+func deletePackage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
-}
 
-func deletePackage(w http.ResponseWriter, r *http.Request) {
 	packageName := r.URL.Query().Get("name")
 	if packageName == "" {
 		http.Error(w, "Missing package name", http.StatusBadRequest)
 		return
 	}
 
-	_, err := db.Exec("DELETE FROM packages WHERE name = ?", packageName)
-	if err != nil {
+	if err := store.DeletePackage(packageName); err == ErrWriteUnavailable {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
 		http.Error(w, "Error deleting package", http.StatusInternalServerError)
 		return
 	}
-	_, _ = db.Exec("DELETE FROM dependencies WHERE package_name = ?", packageName)
-	_, _ = db.Exec("DELETE FROM features WHERE package_name = ?", packageName)
-	_, _ = db.Exec("DELETE FROM feature_dependencies WHERE package_name = ?", packageName)
 
-	// Invalidate Redis cache for the entire package list
-	redisClient.Del(ctx, "all_packages")
+	// Drop every cached response the package appeared in
+	cache.Invalidate(cacheTagMembers, packageTag(packageName))
 
 	w.WriteHeader(http.StatusOK)
 }
@@ -267,33 +215,90 @@ func getPackage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	version := r.URL.Query().Get("version")
+	triplet := r.URL.Query().Get("triplet")
+	cacheKey := packageKeyPrefix + url.Values{"name": {packageName}, "version": {version}, "triplet": {triplet}}.Encode()
+
 	var pkg Package
-	err := db.QueryRow(`SELECT name, version, description, git_url, license, supports, stars, last_modified, cmake_target 
-						FROM packages WHERE name = ?`, packageName).Scan(
-		&pkg.Name, &pkg.Version, &pkg.Description, &pkg.GitURL, &pkg.License, &pkg.Supports, &pkg.Stars, &pkg.LastModified, &pkg.CMakeTarget,
-	)
-	if err == sql.ErrNoRows {
+	if cacheGet(cacheKey, &pkg) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(pkg)
+		return
+	}
+
+	var err error
+	generation := cache.Generation()
+	if version != "" {
+		pkg, err = fetchPackageVersion(packageName, version)
+	} else {
+		pkg, err = store.Package(packageName)
+	}
+	if err == ErrNotFound {
 		http.Error(w, "Package not found", http.StatusNotFound)
 		return
+	} else if err == ErrManifestUnknown {
+		http.Error(w, "Version "+version+" of "+packageName+": "+err.Error(), http.StatusNotFound)
+		return
 	} else if err != nil {
 		http.Error(w, "Error querying database", http.StatusInternalServerError)
 		return
 	}
 
-	pkg.Dependencies = getPackageDependencies(pkg.Name)
-	pkg.Features = getPackageFeatures(pkg.Name)
+	// Only keep the edges that apply to the requested triplet
+	if triplet != "" {
+		ids, err := tripletIdentifiers(triplet)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pkg.forTriplet(ids)
+	}
+
+	cachePut(cacheKey, pkg, []string{packageTag(packageName)}, generation)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(pkg)
 }
 
 func main() {
-	initRedis()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrate(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+
+	var err error
+	store, err = openStore(databaseDriver, databaseURL)
+	if err != nil {
+		log.Fatalf("Failed to open the %s database: %v", databaseDriver, err)
+	}
+
+	cache, err = openCache(cacheDriver, cacheSize)
+	if err != nil {
+		log.Fatalf("Failed to set up the cache: %v", err)
+	}
+
 	http.HandleFunc("/packages", listPackages)
 	http.HandleFunc("/packages/create", createPackage)
 	http.HandleFunc("/packages/delete", deletePackage)
+	http.HandleFunc("/packages/search", searchPackages)
+	http.HandleFunc("/packages/{name}", updatePackage)
 	http.HandleFunc("/package", getPackage)
+	http.HandleFunc("/package/dependents", getPackageDependents)
+	http.HandleFunc("/package/versions", listPackageVersions)
+	http.HandleFunc("/package/supported", getPackageSupport)
+	http.HandleFunc("/package/cmake", getPackageCMake)
+	http.HandleFunc("/cmake", getCMake)
+	http.HandleFunc("/admin/cmake_targets/{name}", adminCMakeTargets)
+	http.HandleFunc("/resolve", resolveDependencies)
+	http.HandleFunc("/lock", lockPackages)
+	http.HandleFunc("/lock/verify", verifyLock)
+
+	if databaseDriver == "sqlite3" {
+		go watchSnapshot(databaseDriver, databaseURL)
+	}
 
 	fmt.Println("Server is running on port 8000...")
-	log.Fatal(http.ListenAndServe(":8000", nil))
+	log.Fatal(http.ListenAndServe(":8000", withSnapshot(http.DefaultServeMux)))
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+
+	"github.com/frate-packages/package-server/schema"
+)
+
+const migrateUsage = `usage: package-server migrate [command]
+
+Migrates the database selected by DATABASE_DRIVER and DATABASE_URL.
+
+commands:
+  up [version]    apply migrations up to version, or all of them (default)
+  down <version>  revert migrations down to version, 0 drops every table
+  status          print the current version and the known migrations`
+
+// runMigrate implements the migrate command and returns the exit code
+func runMigrate(args []string) int {
+	command := "up"
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	target := 0
+	switch {
+	case command == "down" && len(args) != 1, command == "up" && len(args) > 1, command == "status" && len(args) > 0:
+		fmt.Println(migrateUsage)
+		return 2
+	case len(args) == 1:
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			fmt.Printf("invalid schema version %q\n", args[0])
+			return 2
+		}
+		target = n
+	}
+
+	set, err := schema.For(databaseDriver)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	db, err := sql.Open(databaseDriver, databaseURL)
+	if err == nil {
+		err = db.Ping()
+	}
+	if err != nil {
+		fmt.Printf("Failed to open the %s database: %v\n", databaseDriver, err)
+		return 1
+	}
+	defer db.Close()
+
+	var migrations []schema.Migration
+	switch command {
+	case "up":
+		migrations, err = set.Up(db, target)
+		for _, m := range migrations {
+			fmt.Printf("applied %d: %s\n", m.Version, m.Name)
+		}
+	case "down":
+		migrations, err = set.Down(db, target)
+		for _, m := range migrations {
+			fmt.Printf("reverted %d: %s\n", m.Version, m.Name)
+		}
+	case "status":
+		err = printMigrationStatus(db, set)
+	default:
+		fmt.Println(migrateUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	if command != "status" && len(migrations) == 0 {
+		fmt.Println("schema already at the requested version")
+	}
+	return 0
+}
+
+// printMigrationStatus lists every known migration and when it was applied
+func printMigrationStatus(db *sql.DB, set *schema.Set) error {
+	version, err := set.Version(db)
+	if err != nil {
+		return err
+	}
+	history, err := set.History(db)
+	if err != nil {
+		return err
+	}
+	appliedAt := make(map[int]string)
+	for _, a := range history {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	fmt.Printf("%s schema at version %d, latest %d\n", set.Driver, version, set.Latest())
+	for _, m := range set.Migrations {
+		state := "pending"
+		if at, ok := appliedAt[m.Version]; ok {
+			state = "applied " + at
+		}
+		fmt.Printf("  %3d  %-24s %s\n", m.Version, m.Name, state)
+	}
+	return nil
+}
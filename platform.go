@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// platformExpr is a parsed vcpkg platform expression, as used by "supports"
+// and by platform-conditional dependencies
+type platformExpr interface {
+	eval(identifiers map[string]bool) bool
+}
+
+type platformIdent string
+
+type platformNot struct{ expr platformExpr }
+
+type platformAnd []platformExpr
+
+type platformOr []platformExpr
+
+func (e platformIdent) eval(identifiers map[string]bool) bool { return identifiers[string(e)] }
+
+func (e platformNot) eval(identifiers map[string]bool) bool { return !e.expr.eval(identifiers) }
+
+func (e platformAnd) eval(identifiers map[string]bool) bool {
+	for _, expr := range e {
+		if !expr.eval(identifiers) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e platformOr) eval(identifiers map[string]bool) bool {
+	for _, expr := range e {
+		if expr.eval(identifiers) {
+			return true
+		}
+	}
+	return false
+}
+
+// platformParser is a recursive-descent parser for the grammar
+//
+//	expr    = unary { ("&" | "|" | ",") unary }
+//	unary   = "!" unary | primary
+//	primary = identifier | "(" expr ")"
+//
+// As in vcpkg, "&" and "|" cannot be mixed without parentheses, and ","
+// is a legacy spelling of "|".
+type platformParser struct {
+	input string
+	pos   int
+}
+
+func parsePlatformExpr(s string) (platformExpr, error) {
+	p := &platformParser{input: s}
+	p.skipSpace()
+	if p.pos == len(p.input) {
+		// An empty expression matches every platform
+		return platformAnd{}, nil
+	}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos])
+	}
+	return expr, nil
+}
+
+func (p *platformParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("platform expression %q: at offset %d: %s", p.input, p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *platformParser) skipSpace() {
+	for p.pos < len(p.input) && (p.input[p.pos] == ' ' || p.input[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *platformParser) parseExpr() (platformExpr, error) {
+	first, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	operands := []platformExpr{first}
+	var op byte
+	for {
+		p.skipSpace()
+		if p.pos == len(p.input) {
+			break
+		}
+		c := p.input[p.pos]
+		if c != '&' && c != '|' && c != ',' {
+			break
+		}
+		if c == ',' {
+			c = '|'
+		}
+		if op != 0 && op != c {
+			return nil, p.errorf("mixing & and | requires parentheses")
+		}
+		op = c
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, operand)
+	}
+
+	switch op {
+	case '&':
+		return platformAnd(operands), nil
+	case '|':
+		return platformOr(operands), nil
+	default:
+		return first, nil
+	}
+}
+
+func (p *platformParser) parseUnary() (platformExpr, error) {
+	p.skipSpace()
+	if p.pos == len(p.input) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	switch c := p.input[p.pos]; {
+	case c == '!':
+		p.pos++
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return platformNot{expr}, nil
+	case c == '(':
+		p.pos++
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos == len(p.input) || p.input[p.pos] != ')' {
+			return nil, p.errorf("expected )")
+		}
+		p.pos++
+		return expr, nil
+	case isPlatformIdentChar(c):
+		start := p.pos
+		for p.pos < len(p.input) && isPlatformIdentChar(p.input[p.pos]) {
+			p.pos++
+		}
+		return platformIdent(strings.ToLower(p.input[start:p.pos])), nil
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func isPlatformIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// knownArchitectures are the architecture names that can start a triplet
+var knownArchitectures = map[string]bool{
+	"x86": true, "x64": true, "arm": true, "arm64": true, "arm64ec": true, "wasm32": true,
+	"mips64": true, "ppc64le": true, "riscv32": true, "riscv64": true, "s390x": true,
+	"loongarch32": true, "loongarch64": true,
+}
+
+// tripletIdentifiers derives the platform identifiers that are true for a
+// triplet such as x64-linux, x64-windows-static-md or arm64-osx
+func tripletIdentifiers(triplet string) (map[string]bool, error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(triplet)), "-")
+	if len(parts) < 2 || !knownArchitectures[parts[0]] {
+		return nil, fmt.Errorf("invalid triplet %q", triplet)
+	}
+
+	ids := map[string]bool{}
+	arch := parts[0]
+	if arch == "arm" {
+		arch = "arm32"
+	}
+	ids[arch] = true
+	if arch == "arm32" || arch == "arm64" {
+		ids["arm"] = true
+	}
+
+	system := parts[1]
+	modifiers := parts[2:]
+	switch system {
+	case "windows":
+		ids["windows"] = true
+	case "uwp":
+		ids["windows"] = true
+		ids["uwp"] = true
+	case "mingw":
+		ids["windows"] = true
+		ids["mingw"] = true
+	case "xbox":
+		ids["windows"] = true
+		ids["xbox"] = true
+	case "linux", "osx", "ios", "android", "emscripten", "freebsd", "openbsd", "qnx", "solaris":
+		ids[system] = true
+	default:
+		return nil, fmt.Errorf("invalid triplet %q: unknown system %q", triplet, system)
+	}
+
+	// Windows triplets link dynamically unless told otherwise, everything else statically
+	static := !ids["windows"]
+	staticCRT := false
+	switch {
+	case hasModifier(modifiers, "dynamic"):
+		static = false
+	case hasModifier(modifiers, "static"):
+		static = true
+		// MinGW triplets keep the dynamic CRT even when linking statically
+		staticCRT = ids["windows"] && !ids["mingw"] && !hasModifier(modifiers, "md")
+	}
+	ids["static"] = static
+	ids["staticcrt"] = staticCRT
+	return ids, nil
+}
+
+func hasModifier(modifiers []string, modifier string) bool {
+	for _, m := range modifiers {
+		if m == modifier {
+			return true
+		}
+	}
+	return false
+}
+
+// evalPlatform reports whether expr holds for the given identifiers; an
+// empty expression holds everywhere
+func evalPlatform(expr string, identifiers map[string]bool) (bool, error) {
+	parsed, err := parsePlatformExpr(expr)
+	if err != nil {
+		return false, err
+	}
+	return parsed.eval(identifiers), nil
+}
+
+// FeatureSupport reports whether a feature can be built for a triplet
+type FeatureSupport struct {
+	Supports  string `json:"supports,omitempty"`
+	Supported bool   `json:"supported"`
+	Error     string `json:"error,omitempty"`
+}
+
+// PackageSupport is the response body of /package/supported
+type PackageSupport struct {
+	Name      string                    `json:"name"`
+	Triplet   string                    `json:"triplet"`
+	Supports  string                    `json:"supports,omitempty"`
+	Supported bool                      `json:"supported"`
+	Error     string                    `json:"error,omitempty"`
+	Features  map[string]FeatureSupport `json:"features,omitempty"`
+}
+
+func getPackageSupport(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("name")
+	if packageName == "" {
+		http.Error(w, "Missing package name", http.StatusBadRequest)
+		return
+	}
+	triplet := r.URL.Query().Get("triplet")
+	if triplet == "" {
+		http.Error(w, "Missing triplet", http.StatusBadRequest)
+		return
+	}
+	ids, err := tripletIdentifiers(triplet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pkg, err := store.Package(packageName)
+	if err == ErrNotFound {
+		http.Error(w, "Package not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	response := PackageSupport{Name: pkg.Name, Triplet: triplet, Supports: pkg.Supports, Features: map[string]FeatureSupport{}}
+	response.Supported, err = evalPlatform(pkg.Supports, ids)
+	if err != nil {
+		response.Error = err.Error()
+	}
+	for featName, feat := range pkg.Features {
+		support := FeatureSupport{Supports: feat.Supports}
+		support.Supported, err = evalPlatform(feat.Supports, ids)
+		if err != nil {
+			support.Error = err.Error()
+		}
+		// A feature is only usable where the package itself is
+		support.Supported = support.Supported && response.Supported
+		response.Features[featName] = support
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
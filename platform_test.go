@@ -0,0 +1,114 @@
+package main
+
+import "testing"
+
+func TestEvalPlatform(t *testing.T) {
+	linux := map[string]bool{"x64": true, "linux": true, "static": true}
+	windows := map[string]bool{"x64": true, "windows": true}
+	armOSX := map[string]bool{"arm64": true, "arm": true, "osx": true, "static": true}
+
+	tests := []struct {
+		expr        string
+		identifiers map[string]bool
+		want        bool
+	}{
+		{"", linux, true},
+		{"linux", linux, true},
+		{"LINUX", linux, true},
+		{"!windows", linux, true},
+		{"!windows", windows, false},
+		// ! binds tighter than & and |
+		{"!windows & linux", linux, true},
+		{"!windows & linux", windows, false},
+		{"!linux | windows", windows, true},
+		{"!linux | windows", linux, false},
+		{"!(linux | windows)", armOSX, true},
+		{"!(linux | windows)", linux, false},
+		{"!!linux", linux, true},
+		// Parentheses group mixed operators
+		{"(windows | linux) & x64", linux, true},
+		{"(windows | linux) & x64", armOSX, false},
+		{"windows | (osx & arm)", armOSX, true},
+		{"windows | (osx & x64)", armOSX, false},
+		{"((linux))", linux, true},
+		// , is the legacy spelling of |
+		{"windows, linux", linux, true},
+		{"windows,osx", linux, false},
+		{"windows , linux | osx", armOSX, true},
+		{"x64 & linux & static", linux, true},
+		{"x64 & linux & !static", linux, false},
+	}
+	for _, tt := range tests {
+		got, err := evalPlatform(tt.expr, tt.identifiers)
+		if err != nil {
+			t.Errorf("evalPlatform(%q): %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("evalPlatform(%q, %v) = %v, want %v", tt.expr, tt.identifiers, got, tt.want)
+		}
+	}
+}
+
+func TestParsePlatformExprErrors(t *testing.T) {
+	for _, expr := range []string{
+		"windows & linux | osx",
+		"windows | linux & osx",
+		"windows, linux & osx",
+		"(windows",
+		"windows)",
+		"windows &",
+		"!",
+		"& linux",
+		"linux osx",
+		"linux $ osx",
+	} {
+		if _, err := parsePlatformExpr(expr); err == nil {
+			t.Errorf("parsePlatformExpr(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestTripletIdentifiers(t *testing.T) {
+	tests := []struct {
+		triplet string
+		want    []string
+		not     []string
+	}{
+		{"x64-linux", []string{"x64", "linux", "static"}, []string{"windows", "staticcrt", "arm"}},
+		{"x64-linux-dynamic", []string{"x64", "linux"}, []string{"static"}},
+		{"x64-windows", []string{"x64", "windows"}, []string{"static", "staticcrt"}},
+		{"x64-windows-static", []string{"windows", "static", "staticcrt"}, nil},
+		{"x64-windows-static-md", []string{"windows", "static"}, []string{"staticcrt"}},
+		{"x86-uwp", []string{"x86", "windows", "uwp"}, []string{"static"}},
+		{"x64-mingw-dynamic", []string{"windows", "mingw"}, []string{"static", "staticcrt"}},
+		{"x64-mingw-static", []string{"windows", "mingw", "static"}, []string{"staticcrt"}},
+		{"arm64-osx", []string{"arm64", "arm", "osx", "static"}, []string{"arm32"}},
+		{"arm-android", []string{"arm32", "arm", "android"}, []string{"arm64"}},
+		{"wasm32-emscripten", []string{"wasm32", "emscripten", "static"}, nil},
+		{"X64-Linux", []string{"x64", "linux"}, nil},
+	}
+	for _, tt := range tests {
+		ids, err := tripletIdentifiers(tt.triplet)
+		if err != nil {
+			t.Errorf("tripletIdentifiers(%q): %v", tt.triplet, err)
+			continue
+		}
+		for _, id := range tt.want {
+			if !ids[id] {
+				t.Errorf("tripletIdentifiers(%q) lacks %s", tt.triplet, id)
+			}
+		}
+		for _, id := range tt.not {
+			if ids[id] {
+				t.Errorf("tripletIdentifiers(%q) sets %s", tt.triplet, id)
+			}
+		}
+	}
+
+	for _, triplet := range []string{"", "x64", "linux-x64", "x64-beos", "sparc-linux"} {
+		if _, err := tripletIdentifiers(triplet); err == nil {
+			t.Errorf("tripletIdentifiers(%q) succeeded, want an error", triplet)
+		}
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ResolvedNode is one package of a resolved dependency closure
+type ResolvedNode struct {
+	Name        string   `json:"name"`
+	Version     string   `json:"version"`
+	PortVersion int      `json:"port_version,omitempty"`
+	Features    []string `json:"features"`
+	Depth       int      `json:"depth"`
+}
+
+// ResolvedEdge is a dependency between two resolved packages.
+// Feature names the feature of From that introduced the edge, empty for core dependencies.
+type ResolvedEdge struct {
+	From     string   `json:"from"`
+	To       string   `json:"to"`
+	Kind     string   `json:"kind"`
+	Feature  string   `json:"feature,omitempty"`
+	Features []string `json:"features,omitempty"`
+	Platform string   `json:"platform,omitempty"`
+	Host     bool     `json:"host,omitempty"`
+}
+
+// Diagnostic reports a problem found while resolving
+type Diagnostic struct {
+	Type       string   `json:"type"`
+	Package    string   `json:"package,omitempty"`
+	Feature    string   `json:"feature,omitempty"`
+	RequiredBy string   `json:"required_by,omitempty"`
+	Path       []string `json:"path,omitempty"`
+	Message    string   `json:"message"`
+}
+
+// Resolution is the response body of /resolve
+type Resolution struct {
+	Roots       []string       `json:"roots"`
+	Triplet     string         `json:"triplet,omitempty"`
+	Nodes       []ResolvedNode `json:"nodes"`
+	Edges       []ResolvedEdge `json:"edges"`
+	Diagnostics []Diagnostic   `json:"diagnostics"`
+}
+
+const (
+	edgeDependency        = "dependency"
+	edgeFeatureDependency = "feature_dependency"
+	edgeRequiredFeature   = "required_feature"
+)
+
+// resolveRequest asks for a package with a set of features
+type resolveRequest struct {
+	Name            string
+	Features        []string
+	DefaultFeatures bool
+}
+
+// resolvePackage is the data the resolver needs about a single package
+type resolvePackage struct {
+	Version         string
+	PortVersion     int
+	Supports        string
+	Dependencies    []Dependency
+	Features        map[string]Feature
+	DefaultFeatures []DefaultFeature
+}
+
+type resolveState struct {
+	pkg      *resolvePackage
+	features map[string]bool
+	depth    int
+	core     bool
+}
+
+type resolver struct {
+	// identifiers of the target triplet; nil resolves for every platform
+	identifiers map[string]bool
+	triplet     string
+
+	packages    map[string]*resolvePackage
+	states      map[string]*resolveState
+	edges       map[string]ResolvedEdge
+	diagnostics []Diagnostic
+	missing     map[string]bool
+}
+
+// newResolver returns a resolver for the given triplet, or for every
+// platform when triplet is empty
+func newResolver(triplet string) (*resolver, error) {
+	res := &resolver{
+		packages: make(map[string]*resolvePackage),
+		states:   make(map[string]*resolveState),
+		edges:    make(map[string]ResolvedEdge),
+		missing:  make(map[string]bool),
+		triplet:  triplet,
+	}
+	if triplet != "" {
+		ids, err := tripletIdentifiers(triplet)
+		if err != nil {
+			return nil, err
+		}
+		res.identifiers = ids
+	}
+	return res, nil
+}
+
+// applies reports whether an edge with the given platform expression is taken
+func (res *resolver) applies(platform string) bool {
+	if res.identifiers == nil {
+		return true
+	}
+	ok, err := evalPlatform(platform, res.identifiers)
+	return err == nil && ok
+}
+
+// loadPackage fetches a package from the database, returning nil if it does not exist
+func (res *resolver) loadPackage(name string) (*resolvePackage, error) {
+	if pkg, ok := res.packages[name]; ok {
+		return pkg, nil
+	}
+	stored, err := store.Package(name)
+	if err == ErrNotFound {
+		res.packages[name] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	pkg := &resolvePackage{
+		Version:         stored.Version,
+		PortVersion:     stored.PortVersion,
+		Supports:        stored.Supports,
+		Dependencies:    stored.Dependencies,
+		Features:        stored.Features,
+		DefaultFeatures: stored.DefaultFeatures,
+	}
+	res.packages[name] = pkg
+	return pkg, nil
+}
+
+// resolve walks the transitive closure of the requested packages
+func (res *resolver) resolve(requests []resolveRequest) (Resolution, error) {
+	type work struct {
+		name     string
+		features []string
+		defaults bool
+		from     string
+		depth    int
+	}
+
+	var queue []work
+	var roots []string
+	for _, req := range requests {
+		roots = append(roots, req.Name)
+		queue = append(queue, work{name: req.Name, features: req.Features, defaults: req.DefaultFeatures})
+	}
+
+	for len(queue) > 0 {
+		item := queue[0]
+		queue = queue[1:]
+
+		pkg, err := res.loadPackage(item.name)
+		if err != nil {
+			return Resolution{}, err
+		}
+		if pkg == nil {
+			if !res.missing[item.name+"\x00"+item.from] {
+				res.missing[item.name+"\x00"+item.from] = true
+				res.diagnostics = append(res.diagnostics, Diagnostic{
+					Type:       "missing_package",
+					Package:    item.name,
+					RequiredBy: item.from,
+					Message:    "package " + item.name + " is not in the index",
+				})
+			}
+			continue
+		}
+
+		state, seen := res.states[item.name]
+		if !seen {
+			state = &resolveState{pkg: pkg, features: make(map[string]bool), depth: item.depth}
+			res.states[item.name] = state
+			if !res.applies(pkg.Supports) {
+				res.diagnostics = append(res.diagnostics, Diagnostic{
+					Type:       "unsupported",
+					Package:    item.name,
+					RequiredBy: item.from,
+					Message:    "package " + item.name + " does not support " + res.triplet + " (supports: " + pkg.Supports + ")",
+				})
+			}
+		} else if item.depth < state.depth {
+			state.depth = item.depth
+		}
+
+		// Work out which features this visit newly enables
+		wanted := append([]string{}, item.features...)
+		if item.defaults {
+			for _, feat := range pkg.DefaultFeatures {
+				if res.applies(feat.Platform) {
+					wanted = append(wanted, feat.Name)
+				}
+			}
+		}
+		var added []string
+		for _, feat := range wanted {
+			if feat == "" || feat == "core" || state.features[feat] {
+				continue
+			}
+			if _, ok := pkg.Features[feat]; !ok {
+				res.diagnostics = append(res.diagnostics, Diagnostic{
+					Type:       "missing_feature",
+					Package:    item.name,
+					Feature:    feat,
+					RequiredBy: item.from,
+					Message:    "package " + item.name + " has no feature " + feat,
+				})
+				continue
+			}
+			if !res.applies(pkg.Features[feat].Supports) {
+				res.diagnostics = append(res.diagnostics, Diagnostic{
+					Type:       "unsupported",
+					Package:    item.name,
+					Feature:    feat,
+					RequiredBy: item.from,
+					Message:    "feature " + item.name + "[" + feat + "] does not support " + res.triplet + " (supports: " + pkg.Features[feat].Supports + ")",
+				})
+			}
+			state.features[feat] = true
+			added = append(added, feat)
+		}
+
+		next := item.depth + 1
+		if !state.core {
+			state.core = true
+			for _, dep := range pkg.Dependencies {
+				if !res.applies(dep.Platform) {
+					continue
+				}
+				res.addEdge(ResolvedEdge{From: item.name, To: dep.Name, Kind: edgeDependency, Features: dep.Features, Platform: dep.Platform, Host: dep.Host})
+				queue = append(queue, work{name: dep.Name, features: dep.Features, defaults: dep.UsesDefaultFeatures(), from: item.name, depth: next})
+			}
+		}
+
+		for _, feat := range added {
+			for _, dep := range pkg.Features[feat].Dependencies {
+				if !res.applies(dep.Platform) {
+					continue
+				}
+				res.addEdge(ResolvedEdge{From: item.name, To: dep.Name, Kind: edgeFeatureDependency, Feature: feat, Features: dep.Features, Platform: dep.Platform, Host: dep.Host})
+				queue = append(queue, work{name: dep.Name, features: dep.Features, defaults: dep.UsesDefaultFeatures(), from: item.name, depth: next})
+			}
+			for _, req := range pkg.Features[feat].RequiredFeatures {
+				if !res.applies(req.Platform) || coveredByDependency(pkg.Features[feat], req) {
+					continue
+				}
+				target, targetFeat := req.Package, req.Feature
+				if target == "" {
+					target = item.name
+				}
+				res.addEdge(ResolvedEdge{From: item.name, To: target, Kind: edgeRequiredFeature, Feature: feat, Features: []string{targetFeat}, Platform: req.Platform})
+				depth := next
+				if target == item.name {
+					depth = item.depth
+				}
+				queue = append(queue, work{name: target, features: []string{targetFeat}, from: item.name, depth: depth})
+			}
+		}
+	}
+
+	res.detectCycles()
+	return res.result(roots), nil
+}
+
+// coveredByDependency reports whether req is one of the features a dependency
+// of feat asks for, which featureRequirements also stores as a requirement.
+// The feature_dependency edge already carries it.
+func coveredByDependency(feat Feature, req FeatureRequirement) bool {
+	if req.Package == "" {
+		return false
+	}
+	for _, dep := range feat.Dependencies {
+		if dep.Name == req.Package && dep.Platform == req.Platform && slices.Contains(dep.Features, req.Feature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (res *resolver) addEdge(edge ResolvedEdge) {
+	key := strings.Join([]string{edge.From, edge.To, edge.Kind, edge.Feature, strings.Join(edge.Features, ","), edge.Platform, strconv.FormatBool(edge.Host)}, "\x00")
+	res.edges[key] = edge
+}
+
+// detectCycles reports every cycle between distinct packages in the resolved graph
+func (res *resolver) detectCycles() {
+	adjacency := make(map[string][]string)
+	for _, edge := range res.edges {
+		if edge.From != edge.To && res.states[edge.To] != nil {
+			adjacency[edge.From] = append(adjacency[edge.From], edge.To)
+		}
+	}
+	for name := range adjacency {
+		sort.Strings(adjacency[name])
+	}
+
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+	status := make(map[string]int)
+	reported := make(map[string]bool)
+	var stack []string
+
+	var visit func(string)
+	visit = func(name string) {
+		status[name] = inProgress
+		stack = append(stack, name)
+		for _, next := range adjacency[name] {
+			switch status[next] {
+			case unvisited:
+				visit(next)
+			case inProgress:
+				// The cycle is the part of the stack starting at next
+				start := len(stack) - 1
+				for stack[start] != next {
+					start--
+				}
+				path := append(append([]string{}, stack[start:]...), next)
+				key := strings.Join(path, " -> ")
+				if !reported[key] {
+					reported[key] = true
+					res.diagnostics = append(res.diagnostics, Diagnostic{
+						Type:    "cycle",
+						Package: next,
+						Path:    path,
+						Message: "dependency cycle: " + key,
+					})
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		status[name] = done
+	}
+
+	names := make([]string, 0, len(res.states))
+	for name := range res.states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if status[name] == unvisited {
+			visit(name)
+		}
+	}
+}
+
+// result flattens the resolver state into a deterministic Resolution
+func (res *resolver) result(roots []string) Resolution {
+	resolution := Resolution{
+		Roots:       roots,
+		Triplet:     res.triplet,
+		Nodes:       []ResolvedNode{},
+		Edges:       []ResolvedEdge{},
+		Diagnostics: res.diagnostics,
+	}
+	if resolution.Diagnostics == nil {
+		resolution.Diagnostics = []Diagnostic{}
+	}
+
+	for name, state := range res.states {
+		features := make([]string, 0, len(state.features))
+		for feat := range state.features {
+			features = append(features, feat)
+		}
+		sort.Strings(features)
+		resolution.Nodes = append(resolution.Nodes, ResolvedNode{
+			Name:        name,
+			Version:     state.pkg.Version,
+			PortVersion: state.pkg.PortVersion,
+			Features:    features,
+			Depth:       state.depth,
+		})
+	}
+	sort.Slice(resolution.Nodes, func(i, j int) bool {
+		return resolution.Nodes[i].Name < resolution.Nodes[j].Name
+	})
+
+	keys := make([]string, 0, len(res.edges))
+	for key := range res.edges {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		resolution.Edges = append(resolution.Edges, res.edges[key])
+	}
+	return resolution
+}
+
+// splitList parses a comma-separated query parameter, dropping empty entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func resolveDependencies(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("name")
+	if packageName == "" {
+		http.Error(w, "Missing package name", http.StatusBadRequest)
+		return
+	}
+
+	request := resolveRequest{
+		Name:            packageName,
+		Features:        splitList(r.URL.Query().Get("features")),
+		DefaultFeatures: r.URL.Query().Get("default_features") != "false",
+	}
+
+	// Features in any order, or repeated, resolve the same
+	features := slices.Clone(request.Features)
+	sort.Strings(features)
+	features = slices.Compact(features)
+
+	triplet := r.URL.Query().Get("triplet")
+	cacheKey := resolveKeyPrefix + url.Values{
+		"name":             {request.Name},
+		"features":         {strings.Join(features, ",")},
+		"default_features": {strconv.FormatBool(request.DefaultFeatures)},
+		"triplet":          {triplet},
+	}.Encode()
+
+	var resolution Resolution
+	if cacheGet(cacheKey, &resolution) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resolution)
+		return
+	}
+
+	res, err := newResolver(triplet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	generation := cache.Generation()
+	resolution, err = res.resolve([]resolveRequest{request})
+	if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	// The resolution depends on every package looked up, including the
+	// missing ones, which may be created later
+	var tags []string
+	for name := range res.packages {
+		tags = append(tags, packageTag(name))
+	}
+	cachePut(cacheKey, resolution, tags, generation)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resolution)
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+// useMemoryStore points the handlers at a fresh memory store and cache for
+// one test
+func useMemoryStore(t *testing.T, packages ...Package) *memoryStore {
+	t.Helper()
+	previousStore, previousCache := store, cache
+	memory := newMemoryStore()
+	store, cache = memory, newLRUCache(cacheSize)
+	t.Cleanup(func() { store, cache = previousStore, previousCache })
+	for _, pkg := range packages {
+		if err := memory.CreatePackage(pkg); err != nil {
+			t.Fatalf("creating %s: %v", pkg.Name, err)
+		}
+	}
+	return memory
+}
+
+func TestResolveQualifiedFeatureDependencyOnce(t *testing.T) {
+	useMemoryStore(t,
+		Package{Name: "openssl", Version: "3.0.0", Features: map[string]Feature{"tools": {Description: "tools"}}},
+		Package{Name: "curl", Version: "8.0.0", Features: map[string]Feature{
+			"ssl": {
+				Description:  "ssl",
+				Dependencies: []Dependency{{Name: "openssl", Features: []string{"tools"}}},
+				RequiredFeatures: []FeatureRequirement{
+					{Feature: "extra"},
+					{Package: "openssl", Feature: "tools", Platform: "windows"},
+				},
+			},
+			"extra": {Description: "extra"},
+		}},
+	)
+
+	res, err := newResolver("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolution, err := res.resolve([]resolveRequest{{Name: "curl", Features: []string{"ssl"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := map[string]int{}
+	for _, edge := range resolution.Edges {
+		if edge.From == "curl" && edge.To == "openssl" {
+			kinds[edge.Kind+" "+edge.Platform]++
+		}
+	}
+	// The dependency's feature is one edge; the explicit windows-only
+	// requirement is a separate one
+	want := map[string]int{edgeFeatureDependency + " ": 1, edgeRequiredFeature + " windows": 1}
+	if len(kinds) != len(want) {
+		t.Fatalf("curl -> openssl edges = %v, want %v", kinds, want)
+	}
+	for kind, n := range want {
+		if kinds[kind] != n {
+			t.Errorf("curl -> openssl edges = %v, want %v", kinds, want)
+		}
+	}
+}
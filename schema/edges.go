@@ -0,0 +1,233 @@
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Edges are written by both the server and ingest, which keep their own
+// Dependency and FeatureRequirement types with the fields below. Converting to
+// these types keeps one rule for how an edge is stored and matched. The JSON
+// tags match the object form both sides decode.
+
+// Dependency is an edge to another package, stored in dependencies and
+// feature_dependencies
+type Dependency struct {
+	Name            string   `json:"name"`
+	Platform        string   `json:"platform,omitempty"`
+	Host            bool     `json:"host,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	DefaultFeatures *bool    `json:"default-features,omitempty"`
+}
+
+// DependencyColumns selects a stored edge, in the order ScanDependency reads it
+const DependencyColumns = "dependency_name, COALESCE(platform, ''), COALESCE(host, 0), COALESCE(features, ''), default_features"
+
+// DependencyMatch matches a stored edge against Values. A NULL
+// default_features turns the defaults on, so it is the same edge as 1.
+const DependencyMatch = `dependency_name = ? AND COALESCE(platform, '') = ? AND COALESCE(host, 0) = ?
+	AND COALESCE(features, '') = ? AND COALESCE(default_features, 1) = COALESCE(?, 1)`
+
+// ScanDependency reads the leading columns into leading, then the columns
+// selected by DependencyColumns
+func ScanDependency(scan func(dest ...interface{}) error, leading ...interface{}) (Dependency, error) {
+	var dep Dependency
+	var features string
+	var defaults sql.NullBool
+	if err := scan(append(leading, &dep.Name, &dep.Platform, &dep.Host, &features, &defaults)...); err != nil {
+		return dep, err
+	}
+	if features != "" {
+		dep.Features = strings.Split(features, ",")
+	}
+	if defaults.Valid {
+		dep.DefaultFeatures = &defaults.Bool
+	}
+	return dep, nil
+}
+
+// Values returns the stored form of the edge, in DependencyColumns order.
+// Flags are stored as 0 or 1, which every dialect accepts for INTEGER.
+func (d Dependency) Values() []interface{} {
+	var defaults interface{}
+	if d.DefaultFeatures != nil {
+		defaults = boolInt(*d.DefaultFeatures)
+	}
+	return []interface{}{d.Name, d.Platform, boolInt(d.Host), strings.Join(d.Features, ","), defaults}
+}
+
+// Key identifies the edge the way DependencyMatch does, ignoring the order of
+// the features, for diffing sets of edges
+func (d Dependency) Key() string {
+	features := append([]string{}, d.Features...)
+	sort.Strings(features)
+	defaults := "1"
+	if d.DefaultFeatures != nil && !*d.DefaultFeatures {
+		defaults = "0"
+	}
+	return strings.Join([]string{d.Name, d.Platform, boolString(d.Host), strings.Join(features, ","), defaults}, "\x00")
+}
+
+// FeatureRequirement is a feature that a feature turns on, in its own package
+// when Package is empty
+type FeatureRequirement struct {
+	Package  string `json:"package,omitempty"`
+	Feature  string `json:"feature"`
+	Platform string `json:"platform,omitempty"`
+}
+
+// FeatureRequirementMatch matches a feature_requirements row against Values
+const FeatureRequirementMatch = "package_name = ? AND feature_name = ? AND required_package = ? AND required_feature = ? AND COALESCE(platform, '') = ?"
+
+// Values returns the feature_requirements row of a feature of owner. The
+// required package is always stored by name, also when it is owner itself.
+func (r FeatureRequirement) Values(owner, feature string) []interface{} {
+	requiredPackage := r.Package
+	if requiredPackage == "" {
+		requiredPackage = owner
+	}
+	return []interface{}{owner, feature, requiredPackage, r.Feature, r.Platform}
+}
+
+// DefaultFeature is a default_features row
+type DefaultFeature struct {
+	Name     string
+	Platform string
+}
+
+// Feature is a features row with the edges stored for it
+type Feature struct {
+	Description      string
+	Supports         string
+	Dependencies     []Dependency
+	RequiredFeatures []FeatureRequirement
+}
+
+// Edges are the rows of a package outside of packages itself, other than
+// its CMake targets and versions
+type Edges struct {
+	Dependencies    []Dependency
+	DefaultFeatures []DefaultFeature
+	Features        map[string]Feature
+}
+
+// UpdateEdges brings the stored rows of a package from current to desired,
+// inserting and deleting only the rows that differ. Queries use ? placeholders.
+func UpdateEdges(db Execer, name string, current, desired Edges) error {
+	added, removed := diffEdges(current.Dependencies, desired.Dependencies, Dependency.Key)
+	for _, dep := range removed {
+		if _, err := db.Exec("DELETE FROM dependencies WHERE package_name = ? AND "+DependencyMatch, append([]interface{}{name}, dep.Values()...)...); err != nil {
+			return fmt.Errorf("error deleting dependency %s of package %s: %v", dep.Name, name, err)
+		}
+	}
+	for _, dep := range added {
+		if _, err := db.Exec("INSERT INTO dependencies (package_name, dependency_name, platform, host, features, default_features) VALUES (?, ?, ?, ?, ?, ?)", append([]interface{}{name}, dep.Values()...)...); err != nil {
+			return fmt.Errorf("error inserting dependency %s of package %s: %v", dep.Name, name, err)
+		}
+	}
+
+	addedDefaults, removedDefaults := diffEdges(current.DefaultFeatures, desired.DefaultFeatures, func(f DefaultFeature) string { return f.Name + "\x00" + f.Platform })
+	for _, feat := range removedDefaults {
+		if _, err := db.Exec("DELETE FROM default_features WHERE package_name = ? AND feature_name = ? AND COALESCE(platform, '') = ?", name, feat.Name, feat.Platform); err != nil {
+			return fmt.Errorf("error deleting default feature %s of package %s: %v", feat.Name, name, err)
+		}
+	}
+	for _, feat := range addedDefaults {
+		if _, err := db.Exec("INSERT INTO default_features (package_name, feature_name, platform) VALUES (?, ?, ?)", name, feat.Name, feat.Platform); err != nil {
+			return fmt.Errorf("error inserting default feature %s of package %s: %v", feat.Name, name, err)
+		}
+	}
+
+	for featName := range current.Features {
+		if _, keep := desired.Features[featName]; keep {
+			continue
+		}
+		for _, table := range []string{"features", "feature_dependencies", "feature_requirements"} {
+			if _, err := db.Exec("DELETE FROM "+table+" WHERE package_name = ? AND feature_name = ?", name, featName); err != nil {
+				return fmt.Errorf("error deleting feature %s of package %s: %v", featName, name, err)
+			}
+		}
+	}
+
+	for featName, feat := range desired.Features {
+		old, exists := current.Features[featName]
+		if !exists {
+			if _, err := db.Exec("INSERT INTO features (package_name, feature_name, description, supports) VALUES (?, ?, ?, ?)", name, featName, feat.Description, feat.Supports); err != nil {
+				return fmt.Errorf("error inserting feature %s of package %s: %v", featName, name, err)
+			}
+		} else if old.Description != feat.Description || old.Supports != feat.Supports {
+			if _, err := db.Exec("UPDATE features SET description = ?, supports = ? WHERE package_name = ? AND feature_name = ?", feat.Description, feat.Supports, name, featName); err != nil {
+				return fmt.Errorf("error updating feature %s of package %s: %v", featName, name, err)
+			}
+		}
+
+		added, removed := diffEdges(old.Dependencies, feat.Dependencies, Dependency.Key)
+		for _, dep := range removed {
+			if _, err := db.Exec("DELETE FROM feature_dependencies WHERE package_name = ? AND feature_name = ? AND "+DependencyMatch, append([]interface{}{name, featName}, dep.Values()...)...); err != nil {
+				return fmt.Errorf("error deleting dependency %s of feature %s in package %s: %v", dep.Name, featName, name, err)
+			}
+		}
+		for _, dep := range added {
+			if _, err := db.Exec("INSERT INTO feature_dependencies (package_name, feature_name, dependency_name, platform, host, features, default_features) VALUES (?, ?, ?, ?, ?, ?, ?)", append([]interface{}{name, featName}, dep.Values()...)...); err != nil {
+				return fmt.Errorf("error inserting dependency %s of feature %s in package %s: %v", dep.Name, featName, name, err)
+			}
+		}
+
+		// Keyed by the stored row, a requirement on the package itself is
+		// the same with its name or an empty Package
+		requirementKey := func(r FeatureRequirement) string {
+			return fmt.Sprintf("%s\x00%s\x00%s", r.Values(name, featName)[2:]...)
+		}
+		addedReqs, removedReqs := diffEdges(old.RequiredFeatures, feat.RequiredFeatures, requirementKey)
+		for _, req := range removedReqs {
+			if _, err := db.Exec("DELETE FROM feature_requirements WHERE "+FeatureRequirementMatch, req.Values(name, featName)...); err != nil {
+				return fmt.Errorf("error deleting requirement %s of feature %s in package %s: %v", req.Feature, featName, name, err)
+			}
+		}
+		for _, req := range addedReqs {
+			if _, err := db.Exec("INSERT INTO feature_requirements (package_name, feature_name, required_package, required_feature, platform) VALUES (?, ?, ?, ?, ?)", req.Values(name, featName)...); err != nil {
+				return fmt.Errorf("error inserting requirement %s of feature %s in package %s: %v", req.Feature, featName, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// diffEdges returns the entries of desired missing from current, and the
+// entries of current missing from desired, compared by key
+func diffEdges[T any](current, desired []T, key func(T) string) (added, removed []T) {
+	have := make(map[string]bool, len(current))
+	for _, v := range current {
+		have[key(v)] = true
+	}
+	want := make(map[string]bool, len(desired))
+	for _, v := range desired {
+		if !have[key(v)] && !want[key(v)] {
+			added = append(added, v)
+		}
+		want[key(v)] = true
+	}
+	for _, v := range current {
+		if !want[key(v)] {
+			removed = append(removed, v)
+			want[key(v)] = true
+		}
+	}
+	return added, removed
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func boolString(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,81 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDependencyKey(t *testing.T) {
+	yes, no := true, false
+	same := [][2]Dependency{
+		{{Name: "zlib"}, {Name: "zlib", DefaultFeatures: &yes}},
+		{{Name: "curl", Features: []string{"ssl", "http2"}}, {Name: "curl", Features: []string{"http2", "ssl"}}},
+	}
+	for _, pair := range same {
+		if pair[0].Key() != pair[1].Key() {
+			t.Errorf("%+v and %+v should be the same edge", pair[0], pair[1])
+		}
+	}
+
+	different := [][2]Dependency{
+		{{Name: "zlib"}, {Name: "zlib", DefaultFeatures: &no}},
+		{{Name: "zlib"}, {Name: "zlib", Host: true}},
+		{{Name: "zlib"}, {Name: "zlib", Platform: "windows"}},
+		{{Name: "curl"}, {Name: "curl", Features: []string{"ssl"}}},
+	}
+	for _, pair := range different {
+		if pair[0].Key() == pair[1].Key() {
+			t.Errorf("%+v and %+v should be different edges", pair[0], pair[1])
+		}
+	}
+}
+
+func TestDependencyValues(t *testing.T) {
+	no := false
+	tests := []struct {
+		dep  Dependency
+		want []interface{}
+	}{
+		{Dependency{Name: "zlib"}, []interface{}{"zlib", "", 0, "", nil}},
+		{
+			Dependency{Name: "curl", Platform: "!windows", Host: true, Features: []string{"ssl", "http2"}, DefaultFeatures: &no},
+			[]interface{}{"curl", "!windows", 1, "ssl,http2", 0},
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.dep.Values(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v.Values() = %v, want %v", tt.dep, got, tt.want)
+		}
+	}
+}
+
+func TestScanDependency(t *testing.T) {
+	scan := func(dest ...interface{}) error {
+		*dest[0].(*string) = "curl"
+		*dest[1].(*string) = "zlib"
+		*dest[2].(*string) = "windows"
+		*dest[3].(*bool) = true
+		*dest[4].(*string) = "a,b"
+		return nil
+	}
+	var owner string
+	dep, err := ScanDependency(scan, &owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Dependency{Name: "zlib", Platform: "windows", Host: true, Features: []string{"a", "b"}}
+	if owner != "curl" || !reflect.DeepEqual(dep, want) {
+		t.Errorf("ScanDependency = %q, %+v, want curl, %+v", owner, dep, want)
+	}
+}
+
+func TestFeatureRequirementValues(t *testing.T) {
+	own := FeatureRequirement{Feature: "extra"}
+	if got := own.Values("curl", "ssl"); !reflect.DeepEqual(got, []interface{}{"curl", "ssl", "curl", "extra", ""}) {
+		t.Errorf("own requirement stored as %v", got)
+	}
+	other := FeatureRequirement{Package: "openssl", Feature: "tools", Platform: "windows"}
+	if got := other.Values("curl", "ssl"); !reflect.DeepEqual(got, []interface{}{"curl", "ssl", "openssl", "tools", "windows"}) {
+		t.Errorf("requirement on another package stored as %v", got)
+	}
+}
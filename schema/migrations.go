@@ -0,0 +1,513 @@
+package schema
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// Migrations are append-only: once released, a migration is never edited,
+// a change to the schema is always a new version.
+
+// SQLite is the schema of the file ingest writes and the server reads
+var SQLite = &Set{
+	Driver:      "sqlite3",
+	tableExists: "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+	Migrations: []Migration{
+		{
+			Version: 1,
+			Name:    "initial schema",
+			Up:      sqliteInitial,
+			Down:    Exec(dropTables),
+		},
+		{
+			Version: 2,
+			Name:    "package_name indexes",
+			Up:      Exec(createPackageIndexes),
+			Down:    Exec(dropPackageIndexes),
+		},
+		{
+			Version: 3,
+			Name:    "packages_fts search index",
+			Up:      sqliteSearchIndex,
+			Down:    Exec("DROP TABLE IF EXISTS packages_fts"),
+		},
+		{
+			Version: 4,
+			Name:    "package_versions backfill",
+			Up:      sqliteBackfillVersions,
+			// The rows are indistinguishable from snapshots written later
+			Down: func(tx *sql.Tx) error { return nil },
+		},
+		{
+			Version: 5,
+			Name:    "packages source",
+			Up:      Exec(addPackageSource),
+			Down:    Exec(dropPackageSource),
+		},
+	},
+}
+
+// Postgres is the schema of a shared PostgreSQL index
+var Postgres = &Set{
+	Driver:      "postgres",
+	tableExists: "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1",
+	numbered:    true,
+	Migrations: []Migration{
+		{
+			Version: 1,
+			Name:    "initial schema",
+			Up:      Exec(postgresInitial),
+			Down:    Exec(dropTables),
+		},
+		{
+			Version: 2,
+			Name:    "package_name indexes",
+			Up:      Exec(createPackageIndexes),
+			Down:    Exec(dropPackageIndexes),
+		},
+		{
+			Version: 3,
+			Name:    "packages source",
+			Up:      Exec(addPackageSource),
+			Down:    Exec(dropPackageSource),
+		},
+	},
+}
+
+// packages.source is 'api' for packages created or edited through the API,
+// which ingest then leaves alone
+const (
+	addPackageSource  = "ALTER TABLE packages ADD COLUMN source TEXT"
+	dropPackageSource = "ALTER TABLE packages DROP COLUMN source"
+)
+
+const sqliteTables = `
+	CREATE TABLE IF NOT EXISTS packages (
+		name TEXT PRIMARY KEY,
+		version TEXT,
+		port_version INTEGER,
+		description TEXT,
+		homepage TEXT,
+		git_url TEXT,
+		repository_source TEXT,
+		license TEXT,
+		supports TEXT,
+		stars INTEGER,
+		last_modified TEXT,
+		cmake_target TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS dependencies (
+		package_name TEXT,
+		dependency_name TEXT,
+		platform TEXT,
+		host INTEGER,
+		features TEXT,
+		default_features INTEGER,
+		FOREIGN KEY (package_name) REFERENCES packages(name)
+	);
+
+	CREATE TABLE IF NOT EXISTS features (
+		package_name TEXT,
+		feature_name TEXT,
+		description TEXT,
+		supports TEXT,
+		FOREIGN KEY (package_name) REFERENCES packages(name)
+	);
+
+	CREATE TABLE IF NOT EXISTS feature_dependencies (
+		package_name TEXT,
+		feature_name TEXT,
+		dependency_name TEXT,
+		platform TEXT,
+		host INTEGER,
+		features TEXT,
+		default_features INTEGER,
+		FOREIGN KEY (package_name) REFERENCES packages(name)
+	);
+
+	CREATE TABLE IF NOT EXISTS default_features (
+		package_name TEXT,
+		feature_name TEXT,
+		platform TEXT,
+		FOREIGN KEY (package_name) REFERENCES packages(name)
+	);
+
+	CREATE TABLE IF NOT EXISTS feature_requirements (
+		package_name TEXT,
+		feature_name TEXT,
+		required_package TEXT,
+		required_feature TEXT,
+		platform TEXT,
+		FOREIGN KEY (package_name) REFERENCES packages(name)
+	);
+
+	CREATE TABLE IF NOT EXISTS cmake_targets (
+		package_name TEXT,
+		feature_name TEXT,
+		find_package TEXT,
+		component TEXT,
+		target TEXT,
+		module INTEGER,
+		source TEXT,
+		FOREIGN KEY (package_name) REFERENCES packages(name)
+	);
+
+	CREATE TABLE IF NOT EXISTS package_versions (
+		package_name TEXT,
+		version TEXT,
+		port_version INTEGER,
+		tag TEXT,
+		ref_type TEXT,
+		object_sha TEXT,
+		commit_sha TEXT,
+		release_date TEXT,
+		dependencies TEXT,
+		features TEXT,
+		PRIMARY KEY (package_name, version),
+		FOREIGN KEY (package_name) REFERENCES packages(name)
+	);`
+
+// legacyColumns were added to existing tables before schema_version existed
+var legacyColumns = []struct{ table, name, definition string }{
+	{"packages", "port_version", "INTEGER"},
+	{"packages", "homepage", "TEXT"},
+	{"packages", "repository_source", "TEXT"},
+	{"features", "supports", "TEXT"},
+	{"default_features", "platform", "TEXT"},
+	{"package_versions", "port_version", "INTEGER"},
+	{"package_versions", "ref_type", "TEXT"},
+	{"package_versions", "object_sha", "TEXT"},
+	{"package_versions", "commit_sha", "TEXT"},
+	{"dependencies", "platform", "TEXT"},
+	{"dependencies", "host", "INTEGER"},
+	{"dependencies", "features", "TEXT"},
+	{"dependencies", "default_features", "INTEGER"},
+	{"feature_dependencies", "platform", "TEXT"},
+	{"feature_dependencies", "host", "INTEGER"},
+	{"feature_dependencies", "features", "TEXT"},
+	{"feature_dependencies", "default_features", "INTEGER"},
+}
+
+// sqliteInitial creates the tables, and brings files written before
+// schema_version existed to the same columns
+func sqliteInitial(tx *sql.Tx) error {
+	if _, err := tx.Exec(sqliteTables); err != nil {
+		return err
+	}
+	for _, column := range legacyColumns {
+		var count int
+		err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", column.table, column.name).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := tx.Exec("ALTER TABLE " + column.table + " ADD COLUMN " + column.name + " " + column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// postgresInitial matches sqliteTables. cmake_targets gets an explicit id since
+// PostgreSQL has no rowid to keep the edited order.
+const postgresInitial = `
+	CREATE TABLE IF NOT EXISTS packages (
+		name TEXT PRIMARY KEY,
+		version TEXT,
+		port_version INTEGER,
+		description TEXT,
+		homepage TEXT,
+		git_url TEXT,
+		repository_source TEXT,
+		license TEXT,
+		supports TEXT,
+		stars INTEGER,
+		last_modified TEXT,
+		cmake_target TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS dependencies (
+		package_name TEXT REFERENCES packages(name),
+		dependency_name TEXT,
+		platform TEXT,
+		host INTEGER,
+		features TEXT,
+		default_features INTEGER
+	);
+
+	CREATE TABLE IF NOT EXISTS features (
+		package_name TEXT REFERENCES packages(name),
+		feature_name TEXT,
+		description TEXT,
+		supports TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS feature_dependencies (
+		package_name TEXT REFERENCES packages(name),
+		feature_name TEXT,
+		dependency_name TEXT,
+		platform TEXT,
+		host INTEGER,
+		features TEXT,
+		default_features INTEGER
+	);
+
+	CREATE TABLE IF NOT EXISTS default_features (
+		package_name TEXT REFERENCES packages(name),
+		feature_name TEXT,
+		platform TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS feature_requirements (
+		package_name TEXT REFERENCES packages(name),
+		feature_name TEXT,
+		required_package TEXT,
+		required_feature TEXT,
+		platform TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS cmake_targets (
+		id BIGSERIAL PRIMARY KEY,
+		package_name TEXT REFERENCES packages(name),
+		feature_name TEXT,
+		find_package TEXT,
+		component TEXT,
+		target TEXT,
+		module INTEGER,
+		source TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS package_versions (
+		package_name TEXT REFERENCES packages(name),
+		version TEXT,
+		port_version INTEGER,
+		tag TEXT,
+		ref_type TEXT,
+		object_sha TEXT,
+		commit_sha TEXT,
+		release_date TEXT,
+		dependencies TEXT,
+		features TEXT,
+		PRIMARY KEY (package_name, version)
+	);`
+
+// Tables holds the index in every schema, packages before the tables
+// referencing it
+var Tables = []string{"packages", "dependencies", "features", "feature_dependencies", "default_features", "feature_requirements", "cmake_targets", "package_versions"}
+
+// dropTables reverts the initial schema, children before packages
+const dropTables = `
+	DROP TABLE IF EXISTS package_versions;
+	DROP TABLE IF EXISTS cmake_targets;
+	DROP TABLE IF EXISTS feature_requirements;
+	DROP TABLE IF EXISTS default_features;
+	DROP TABLE IF EXISTS feature_dependencies;
+	DROP TABLE IF EXISTS features;
+	DROP TABLE IF EXISTS dependencies;
+	DROP TABLE IF EXISTS packages;`
+
+// createPackageIndexes covers the per-package lookups of the child tables
+const createPackageIndexes = `
+	CREATE INDEX IF NOT EXISTS dependencies_package_name ON dependencies (package_name);
+	CREATE INDEX IF NOT EXISTS features_package_name ON features (package_name);
+	CREATE INDEX IF NOT EXISTS feature_dependencies_package_name ON feature_dependencies (package_name, feature_name);
+	CREATE INDEX IF NOT EXISTS default_features_package_name ON default_features (package_name);
+	CREATE INDEX IF NOT EXISTS feature_requirements_package_name ON feature_requirements (package_name, feature_name);
+	CREATE INDEX IF NOT EXISTS cmake_targets_package_name ON cmake_targets (package_name);`
+
+const dropPackageIndexes = `
+	DROP INDEX IF EXISTS dependencies_package_name;
+	DROP INDEX IF EXISTS features_package_name;
+	DROP INDEX IF EXISTS feature_dependencies_package_name;
+	DROP INDEX IF EXISTS default_features_package_name;
+	DROP INDEX IF EXISTS feature_requirements_package_name;
+	DROP INDEX IF EXISTS cmake_targets_package_name;`
+
+// The search index needs SQLite built with FTS5, e.g. `go build -tags sqlite_fts5`
+const createSearchIndex = `
+	CREATE VIRTUAL TABLE IF NOT EXISTS packages_fts USING fts5(
+		name,
+		description,
+		features,
+		feature_descriptions
+	)`
+
+// InsertSearchDocuments indexes every package; append a condition on p, e.g.
+// " WHERE p.name = ?", to index only some of them
+const InsertSearchDocuments = `
+	INSERT INTO packages_fts (name, description, features, feature_descriptions)
+	SELECT p.name, p.description,
+		COALESCE((SELECT group_concat(feature_name, ' ') FROM features f WHERE f.package_name = p.name), ''),
+		COALESCE((SELECT group_concat(description, ' ') FROM features f WHERE f.package_name = p.name), '')
+	FROM packages p`
+
+// Execer is the part of *sql.DB and *sql.Tx that RebuildSearchIndex uses
+type Execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// RebuildSearchIndex refills packages_fts from the packages and features tables
+func RebuildSearchIndex(db Execer) error {
+	if _, err := db.Exec("DELETE FROM packages_fts"); err != nil {
+		return err
+	}
+	_, err := db.Exec(InsertSearchDocuments)
+	return err
+}
+
+// sqliteSearchIndex creates packages_fts and indexes the packages already
+// stored. Files from before this migration may have the table already.
+func sqliteSearchIndex(tx *sql.Tx) error {
+	if _, err := tx.Exec(createSearchIndex); err != nil {
+		return fmt.Errorf("%v (SQLite must be built with FTS5: go build -tags sqlite_fts5, or make)", err)
+	}
+	return RebuildSearchIndex(tx)
+}
+
+// versionFeature is a feature of a package_versions snapshot, in the JSON the
+// server decodes
+type versionFeature struct {
+	Description      string               `json:"description"`
+	RequiredFeatures []FeatureRequirement `json:"required_features,omitempty"`
+	Dependencies     []Dependency         `json:"dependencies,omitempty"`
+	Supports         string               `json:"supports,omitempty"`
+}
+
+// sqliteBackfillVersions gives every package a package_versions row for its
+// current version, with the stored edges as the snapshot. Files written before
+// package_versions existed have no rows, so no version of them could be pinned.
+func sqliteBackfillVersions(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT name, version, COALESCE(port_version, 0), COALESCE(last_modified, '') FROM packages p
+		WHERE version IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM package_versions v WHERE v.package_name = p.name AND v.version = p.version)`)
+	if err != nil {
+		return err
+	}
+	type current struct {
+		name, version, released string
+		portVersion             int
+	}
+	var packages []current
+	for rows.Next() {
+		var pkg current
+		if err := rows.Scan(&pkg.name, &pkg.version, &pkg.portVersion, &pkg.released); err != nil {
+			rows.Close()
+			return err
+		}
+		packages = append(packages, pkg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, pkg := range packages {
+		dependencies, features, err := storedSnapshot(tx, pkg.name)
+		if err != nil {
+			return fmt.Errorf("%s: %v", pkg.name, err)
+		}
+		_, err = tx.Exec(`INSERT INTO package_versions (package_name, version, port_version, tag, release_date, dependencies, features)
+			VALUES (?, ?, ?, '', ?, ?, ?)`, pkg.name, pkg.version, pkg.portVersion, pkg.released, dependencies, features)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storedSnapshot encodes the dependencies and features stored for a package
+func storedSnapshot(tx *sql.Tx, name string) (dependencies, features string, err error) {
+	deps := []Dependency{}
+	err = eachRow(tx, "SELECT "+DependencyColumns+" FROM dependencies WHERE package_name = ?", name, func(rows *sql.Rows) error {
+		dep, err := ScanDependency(rows.Scan)
+		deps = append(deps, dep)
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	feats := make(map[string]versionFeature)
+	err = eachRow(tx, "SELECT feature_name, COALESCE(description, ''), COALESCE(supports, '') FROM features WHERE package_name = ?", name, func(rows *sql.Rows) error {
+		var featureName string
+		var feat versionFeature
+		if err := rows.Scan(&featureName, &feat.Description, &feat.Supports); err != nil {
+			return err
+		}
+		feats[featureName] = feat
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+	err = eachRow(tx, "SELECT feature_name, "+DependencyColumns+" FROM feature_dependencies WHERE package_name = ?", name, func(rows *sql.Rows) error {
+		var featureName string
+		dep, err := ScanDependency(rows.Scan, &featureName)
+		if feat, ok := feats[featureName]; ok && err == nil {
+			feat.Dependencies = append(feat.Dependencies, dep)
+			feats[featureName] = feat
+		}
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	// Requirements on the package itself are written with an empty package
+	err = eachRow(tx, "SELECT feature_name, required_package, required_feature, COALESCE(platform, '') FROM feature_requirements WHERE package_name = ?", name, func(rows *sql.Rows) error {
+		var featureName string
+		var req FeatureRequirement
+		if err := rows.Scan(&featureName, &req.Package, &req.Feature, &req.Platform); err != nil {
+			return err
+		}
+		if req.Package == name {
+			req.Package = ""
+		}
+		if feat, ok := feats[featureName]; ok {
+			feat.RequiredFeatures = append(feat.RequiredFeatures, req)
+			feats[featureName] = feat
+		}
+		return nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	encodedDeps, err := json.Marshal(deps)
+	if err != nil {
+		return "", "", err
+	}
+	encodedFeats, err := json.Marshal(feats)
+	if err != nil {
+		return "", "", err
+	}
+	return string(encodedDeps), string(encodedFeats), nil
+}
+
+// eachRow runs query with a single argument and calls fn for every row
+func eachRow(tx *sql.Tx, query string, arg interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := tx.Query(query, arg)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// CheckFTS5 returns an error when the SQLite of db lacks FTS5, which the
+// schema needs from version 3
+func CheckFTS5(db Execer) error {
+	if _, err := db.Exec("CREATE VIRTUAL TABLE temp.fts5_probe USING fts5(x)"); err != nil {
+		return fmt.Errorf("SQLite lacks FTS5, build with -tags sqlite_fts5 (or run make): %v", err)
+	}
+	_, err := db.Exec("DROP TABLE temp.fts5_probe")
+	return err
+}
@@ -0,0 +1,232 @@
+// Package schema holds the numbered migrations of the index database and
+// applies them. The server and ingest share it, so both agree on what a
+// given schema_version means.
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration is one numbered step of a backend's schema. Up and Down run in a
+// single transaction together with the schema_version bookkeeping.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *sql.Tx) error
+	Down    func(tx *sql.Tx) error
+}
+
+// Set is the ordered list of migrations of one database backend
+type Set struct {
+	Driver     string
+	Migrations []Migration
+
+	// tableExists counts the tables with the name given as its only argument
+	tableExists string
+	// numbered uses $1, $2 placeholders instead of ?
+	numbered bool
+}
+
+// Applied is a row of schema_version
+type Applied struct {
+	Version   int
+	Name      string
+	AppliedAt string
+}
+
+const createVersionTable = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	)`
+
+// For returns the migrations of a database/sql driver name
+func For(driver string) (*Set, error) {
+	switch driver {
+	case "sqlite3":
+		return SQLite, nil
+	case "postgres":
+		return Postgres, nil
+	default:
+		return nil, fmt.Errorf("no schema migrations for driver %q", driver)
+	}
+}
+
+// Latest is the version the schema has after every migration ran
+func (s *Set) Latest() int {
+	if len(s.Migrations) == 0 {
+		return 0
+	}
+	return s.Migrations[len(s.Migrations)-1].Version
+}
+
+// bind rewrites the ? placeholders of query for the backend
+func (s *Set) bind(query string) string {
+	if !s.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Version returns the current schema version of db, 0 when no migration ever
+// ran. Databases written before schema_version existed also report 0.
+func (s *Set) Version(db *sql.DB) (int, error) {
+	var count int
+	if err := db.QueryRow(s.tableExists, "schema_version").Scan(&count); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// History returns the applied migrations, oldest first
+func (s *Set) History(db *sql.DB) ([]Applied, error) {
+	var count int
+	if err := db.QueryRow(s.tableExists, "schema_version").Scan(&count); err != nil || count == 0 {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_version ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []Applied
+	for rows.Next() {
+		var a Applied
+		if err := rows.Scan(&a.Version, &a.Name, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// Check returns an error unless db is at exactly the latest version. Serving
+// an older schema would fail on missing columns, and a newer one may mean
+// columns whose meaning this build does not know.
+func (s *Set) Check(db *sql.DB) error {
+	version, err := s.Version(db)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+	switch latest := s.Latest(); {
+	case version < latest:
+		return fmt.Errorf("database schema is at version %d, this build needs %d; run the migrate command first", version, latest)
+	case version > latest:
+		return fmt.Errorf("database schema is at version %d, newer than the %d this build knows; upgrade the server", version, latest)
+	}
+	return nil
+}
+
+// Up applies the migrations after the current version up to target and
+// returns the ones it ran. A target of 0 means the latest version.
+func (s *Set) Up(db *sql.DB, target int) ([]Migration, error) {
+	if target == 0 {
+		target = s.Latest()
+	}
+	if target > s.Latest() {
+		return nil, fmt.Errorf("unknown schema version %d, the latest is %d", target, s.Latest())
+	}
+	version, err := s.Version(db)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema version: %v", err)
+	}
+	if version > target {
+		return nil, fmt.Errorf("database schema is at version %d, past %d; migrate down instead", version, target)
+	}
+	if _, err := db.Exec(createVersionTable); err != nil {
+		return nil, fmt.Errorf("error creating schema_version: %v", err)
+	}
+
+	var ran []Migration
+	for _, m := range s.Migrations {
+		if m.Version <= version || m.Version > target {
+			continue
+		}
+		err := s.inTx(db, m.Up, func(tx *sql.Tx) error {
+			_, err := tx.Exec(s.bind("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)"),
+				m.Version, m.Name, time.Now().UTC().Format(time.RFC3339))
+			return err
+		})
+		if err != nil {
+			return ran, fmt.Errorf("error applying migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		ran = append(ran, m)
+	}
+	return ran, nil
+}
+
+// Down reverts the applied migrations above target, newest first, and
+// returns the ones it reverted
+func (s *Set) Down(db *sql.DB, target int) ([]Migration, error) {
+	if target < 0 {
+		return nil, fmt.Errorf("invalid schema version %d", target)
+	}
+	version, err := s.Version(db)
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema version: %v", err)
+	}
+	if version > s.Latest() {
+		return nil, fmt.Errorf("database schema is at version %d, newer than the %d this build knows", version, s.Latest())
+	}
+
+	var reverted []Migration
+	for i := len(s.Migrations) - 1; i >= 0; i-- {
+		m := s.Migrations[i]
+		if m.Version > version || m.Version <= target {
+			continue
+		}
+		err := s.inTx(db, m.Down, func(tx *sql.Tx) error {
+			_, err := tx.Exec(s.bind("DELETE FROM schema_version WHERE version = ?"), m.Version)
+			return err
+		})
+		if err != nil {
+			return reverted, fmt.Errorf("error reverting migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		reverted = append(reverted, m)
+	}
+	return reverted, nil
+}
+
+// inTx runs the steps in one transaction
+func (s *Set) inTx(db *sql.DB, steps ...func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, step := range steps {
+		if err := step(tx); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Exec returns a migration step running the given statements
+func Exec(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 200
+)
+
+// SearchResult is a package matched by /packages/search with its ranking score
+type SearchResult struct {
+	Package
+	Score float64 `json:"score"`
+}
+
+// SearchResponse is the response body of /packages/search
+type SearchResponse struct {
+	Query   string         `json:"query"`
+	Total   int            `json:"total"`
+	Results []SearchResult `json:"results"`
+}
+
+// searchQuery is the parsed form of the q parameter
+type searchQuery struct {
+	Terms    []string
+	Licenses []string
+	Deps     []string
+	Features []string
+}
+
+// searchHit is a package matched by a Store before ranking
+type searchHit struct {
+	Name      string
+	Relevance float64
+	Stars     int
+}
+
+// scanSearchHits reads name, relevance and stars rows
+func scanSearchHits(rows *sql.Rows, err error) ([]searchHit, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []searchHit
+	for rows.Next() {
+		var hit searchHit
+		if err := rows.Scan(&hit.Name, &hit.Relevance, &hit.Stars); err != nil {
+			return nil, err
+		}
+		hits = append(hits, hit)
+	}
+	return hits, rows.Err()
+}
+
+// parseSearchQuery splits q into free-text terms and field filters.
+// Double-quoted text is kept together as a phrase.
+func parseSearchQuery(q string) searchQuery {
+	var sq searchQuery
+	for _, token := range tokenizeSearchQuery(q) {
+		field, value, found := strings.Cut(token, ":")
+		if !found || value == "" || strings.HasPrefix(token, `"`) {
+			sq.Terms = append(sq.Terms, strings.Trim(token, `"`))
+			continue
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(field) {
+		case "license":
+			sq.Licenses = append(sq.Licenses, value)
+		case "dep":
+			sq.Deps = append(sq.Deps, value)
+		case "feature":
+			sq.Features = append(sq.Features, value)
+		default:
+			sq.Terms = append(sq.Terms, token)
+		}
+	}
+	return sq
+}
+
+func tokenizeSearchQuery(q string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range q {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+// matchExpression quotes every term so user input is never parsed as FTS5 syntax
+func (sq searchQuery) matchExpression() string {
+	var parts []string
+	for _, term := range sq.Terms {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		parts = append(parts, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+	}
+	return strings.Join(parts, " ")
+}
+
+// filterSQL returns the conditions on packages p for the field filters
+func (sq searchQuery) filterSQL(d dialect) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, license := range sq.Licenses {
+		conds = append(conds, "p.license "+d.like+" ?")
+		args = append(args, "%"+license+"%")
+	}
+	for _, dep := range sq.Deps {
+		conds = append(conds, `(EXISTS (SELECT 1 FROM dependencies d WHERE d.package_name = p.name AND d.dependency_name = ?)
+			OR EXISTS (SELECT 1 FROM feature_dependencies fd WHERE fd.package_name = p.name AND fd.dependency_name = ?))`)
+		args = append(args, dep, dep)
+	}
+	for _, feature := range sq.Features {
+		conds = append(conds, "EXISTS (SELECT 1 FROM features f WHERE f.package_name = p.name AND f.feature_name = ?)")
+		args = append(args, feature)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// searchScore combines text relevance with a logarithmic popularity boost.
+// Filter-only queries have no relevance and rank by popularity alone.
+func searchScore(relevance float64, stars int) float64 {
+	if relevance == 0 {
+		relevance = 1
+	}
+	return relevance * (1 + math.Log10(1+float64(stars))/5)
+}
+
+func searchPackages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, "Missing search query", http.StatusBadRequest)
+		return
+	}
+	limit := defaultSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxSearchLimit)
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid offset %q", v), http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	found, err := store.SearchPackages(parseSearchQuery(q))
+	if err == ErrSearchUnavailable {
+		http.Error(w, "Search index unavailable", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, "Error querying search index", http.StatusInternalServerError)
+		return
+	}
+
+	type hit struct {
+		name  string
+		score float64
+	}
+	hits := make([]hit, 0, len(found))
+	for _, h := range found {
+		hits = append(hits, hit{name: h.Name, score: searchScore(h.Relevance, h.Stars)})
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].name < hits[j].name
+	})
+
+	response := SearchResponse{Query: q, Total: len(hits), Results: []SearchResult{}}
+	for i := offset; i < len(hits) && i < offset+limit; i++ {
+		pkg, err := store.Package(hits[i].name)
+		if err != nil {
+			continue
+		}
+		response.Results = append(response.Results, SearchResult{Package: pkg, Score: hits[i].score})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,177 @@
+// Package semver orders version tags the way the server and ingest both need
+// to: by semver precedence, whatever prefix or separators a project uses.
+package semver
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// semverPattern finds the version at the end of a tag: a numeric core with
+// `.` or `_` separators, optionally followed by a prerelease such as -rc.1.
+// Any prefix (v, release-, curl-, boost_) is ignored.
+var semverPattern = regexp.MustCompile(`(?i)(\d+(?:[._]\d+)+)(?:[-.]?((?:alpha|beta|pre|preview|rc)[.-]?\d*))?$`)
+
+// datePattern matches vcpkg's version-date scheme, YYYY-MM-DD
+var datePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// Version is a tag normalized for comparison
+type Version struct {
+	Core       []int
+	Prerelease []string
+}
+
+// Parse normalizes a tag like v1.2.3, boost-1_84_0 or 2.0.0-rc1. Branch
+// names and other tags without a version are not parsed. Dates such as
+// 2024-04-23 compare as 2024.4.23.
+func Parse(tag string) (Version, bool) {
+	if datePattern.MatchString(tag) {
+		tag = strings.ReplaceAll(tag, "-", ".")
+	}
+	m := semverPattern.FindStringSubmatch(tag)
+	if m == nil {
+		return Version{}, false
+	}
+	var v Version
+	for _, part := range strings.FieldsFunc(m[1], func(r rune) bool { return r == '.' || r == '_' }) {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return Version{}, false
+		}
+		v.Core = append(v.Core, n)
+	}
+	if m[2] != "" {
+		v.Prerelease = splitPrerelease(strings.ToLower(m[2]))
+	}
+	return v, true
+}
+
+// splitPrerelease splits rc10 or rc.10 into [rc 10], so the number compares numerically
+func splitPrerelease(pre string) []string {
+	var parts []string
+	for _, field := range strings.FieldsFunc(pre, func(r rune) bool { return r == '.' || r == '-' }) {
+		i := strings.IndexAny(field, "0123456789")
+		if i > 0 {
+			parts = append(parts, field[:i], field[i:])
+		} else {
+			parts = append(parts, field)
+		}
+	}
+	return parts
+}
+
+// Compare orders versions by semver precedence. Missing core parts count as
+// zero, so 1.2 equals 1.2.0, and a prerelease sorts before its release.
+func (v Version) Compare(o Version) int {
+	for i := 0; i < len(v.Core) || i < len(o.Core); i++ {
+		a, b := 0, 0
+		if i < len(v.Core) {
+			a = v.Core[i]
+		}
+		if i < len(o.Core) {
+			b = o.Core[i]
+		}
+		if a != b {
+			return cmpInt(a, b)
+		}
+	}
+
+	switch {
+	case len(v.Prerelease) == 0 && len(o.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(o.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		a, b := v.Prerelease[i], o.Prerelease[i]
+		na, errA := strconv.Atoi(a)
+		nb, errB := strconv.Atoi(b)
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				return cmpInt(na, nb)
+			}
+		case errA == nil:
+			// Numeric identifiers have lower precedence than alphanumeric ones
+			return -1
+		case errB == nil:
+			return 1
+		case a != b:
+			return strings.Compare(a, b)
+		}
+	}
+	return cmpInt(len(v.Prerelease), len(o.Prerelease))
+}
+
+func cmpInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Compare orders version strings by semver precedence, ignoring
+// prefixes like v or curl-. Strings that are not versions, such as branch
+// names, sort after every version and among themselves by name.
+func Compare(a, b string) int {
+	va, okA := Parse(a)
+	vb, okB := Parse(b)
+	switch {
+	case okA && okB:
+		return va.Compare(vb)
+	case okA:
+		return -1
+	case okB:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// SortTags orders tags from oldest to newest version. Tags that are not
+// versions, like branch names, go last in their original order. Spellings of
+// the same version (v1.2 and 1.2) are ordered by name to keep the result stable.
+func SortTags(tags []string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		a, okA := Parse(tags[i])
+		b, okB := Parse(tags[j])
+		if !okA || !okB {
+			return okA && !okB
+		}
+		if c := a.Compare(b); c != 0 {
+			return c < 0
+		}
+		return tags[i] < tags[j]
+	})
+}
+
+// Latest returns the highest release among tags, falling back to the
+// highest prerelease when there is no release. Branch names are never picked.
+func Latest(tags []string) (string, bool) {
+	var latest, latestPre string
+	var best, bestPre Version
+	for _, tag := range tags {
+		v, ok := Parse(tag)
+		switch {
+		case !ok:
+		case len(v.Prerelease) == 0:
+			if latest == "" || v.Compare(best) > 0 {
+				latest, best = tag, v
+			}
+		default:
+			if latestPre == "" || v.Compare(bestPre) > 0 {
+				latestPre, bestPre = tag, v
+			}
+		}
+	}
+	if latest != "" {
+		return latest, true
+	}
+	return latestPre, latestPre != ""
+}
@@ -0,0 +1,109 @@
+package semver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		tag        string
+		core       []int
+		prerelease []string
+	}{
+		{"1.2.3", []int{1, 2, 3}, nil},
+		{"v1.2.3", []int{1, 2, 3}, nil},
+		{"V1.2", []int{1, 2}, nil},
+		{"word-1_2_3", []int{1, 2, 3}, nil},
+		{"boost_1_84_0", []int{1, 84, 0}, nil},
+		{"curl-8.5.0", []int{8, 5, 0}, nil},
+		{"2.0.0-rc1", []int{2, 0, 0}, []string{"rc", "1"}},
+		{"v2.0.0-beta.10", []int{2, 0, 0}, []string{"beta", "10"}},
+		{"3.0-RC", []int{3, 0}, []string{"rc"}},
+		{"2024-04-23", []int{2024, 4, 23}, nil},
+	}
+	for _, tt := range tests {
+		v, ok := Parse(tt.tag)
+		if !ok {
+			t.Errorf("Parse(%q) failed", tt.tag)
+			continue
+		}
+		if !reflect.DeepEqual(v.Core, tt.core) || !reflect.DeepEqual(v.Prerelease, tt.prerelease) {
+			t.Errorf("Parse(%q) = %v %v, want %v %v", tt.tag, v.Core, v.Prerelease, tt.core, tt.prerelease)
+		}
+	}
+
+	for _, tag := range []string{"master", "main", "latest", "release", "v1", "1.2.x", ""} {
+		if v, ok := Parse(tag); ok {
+			t.Errorf("Parse(%q) = %v, want no version", tag, v)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2", "1.2.0", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"word-1_2_3", "1.2.3", 0},
+		{"1.2", "1.2.1", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"v2.0.0", "1.99.99", 1},
+		// Prereleases sort before their release, in semver order
+		{"1.0.0-alpha", "1.0.0-beta", -1},
+		{"1.0.0-beta", "1.0.0-beta.2", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc1", "1.0.0-rc10", -1},
+		{"1.0.0-rc.1", "1.0.0-rc1", 0},
+		{"1.0.0-rc10", "1.0.0", -1},
+		{"1.0.0", "1.0.1-alpha", -1},
+		// Branch names sort after every version
+		{"master", "1.0.0", 1},
+		{"99.0.0", "main", -1},
+		{"main", "master", -1},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestSortTags(t *testing.T) {
+	tags := []string{"master", "v1.10.0", "1.2.0-rc1", "v1.2", "main", "1.2", "v1.9.0"}
+	SortTags(tags)
+	want := []string{"1.2.0-rc1", "1.2", "v1.2", "v1.9.0", "v1.10.0", "master", "main"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("SortTags = %v, want %v", tags, want)
+	}
+}
+
+func TestLatest(t *testing.T) {
+	tests := []struct {
+		tags []string
+		want string
+		ok   bool
+	}{
+		{[]string{"v1.2.0", "v1.10.0", "v1.9.3"}, "v1.10.0", true},
+		// Branch names are never picked, whatever their order
+		{[]string{"master", "v1.2.0", "main", "latest"}, "v1.2.0", true},
+		{[]string{"v1.2.0", "stable", "zzz"}, "v1.2.0", true},
+		{[]string{"master", "main"}, "", false},
+		{nil, "", false},
+		// A release wins over a newer prerelease
+		{[]string{"1.0.0", "2.0.0-rc1"}, "1.0.0", true},
+		{[]string{"master", "2.0.0-beta", "2.0.0-rc1"}, "2.0.0-rc1", true},
+	}
+	for _, tt := range tests {
+		got, ok := Latest(tt.tags)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Latest(%v) = %q, %v, want %q, %v", tt.tags, got, ok, tt.want, tt.ok)
+		}
+	}
+}
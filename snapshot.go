@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// snapshotPollInterval is how often the SQLite file is checked for a new snapshot
+const snapshotPollInterval = 5 * time.Second
+
+// snapshotMu guards the store: requests hold it for reading, and reopenStore
+// takes it for writing while it swaps the store
+var snapshotMu sync.RWMutex
+
+// withSnapshot keeps a request on one store from start to finish
+func withSnapshot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snapshotMu.RLock()
+		defer snapshotMu.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// watchSnapshot reopens the database whenever ingest renames a new file over
+// path. Writes made by the server itself keep the same file and are ignored.
+func watchSnapshot(driver, path string) {
+	last, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Not watching %s for new snapshots: %v", path, err)
+		return
+	}
+	for range time.Tick(snapshotPollInterval) {
+		info, err := os.Stat(path)
+		if err != nil || os.SameFile(last, info) {
+			continue
+		}
+		if err := reopenStore(driver, path); err != nil {
+			log.Printf("Failed to open the new snapshot of %s: %v", path, err)
+			continue
+		}
+		last = info
+		log.Printf("Reopened %s after a new snapshot was swapped in", path)
+	}
+}
+
+// reopenStore switches to a freshly opened store, keeping the old one if the
+// new database cannot be prepared
+func reopenStore(driver, url string) error {
+	next, err := openStore(driver, url)
+	if err != nil {
+		return err
+	}
+
+	snapshotMu.Lock()
+	previous := store
+	store = next
+	snapshotMu.Unlock()
+
+	previous.Close()
+	cache.Invalidate(cacheTagAll)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned by a Store when a package or version does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrWriteUnavailable is returned by writes while ingest replaces the
+// database, since the new snapshot would drop them
+var ErrWriteUnavailable = errors.New("the package index is being replaced by an ingest, retry later")
+
+// ErrSearchUnavailable is returned by SearchPackages when the backend has no search index
+var ErrSearchUnavailable = errors.New("search index unavailable")
+
+// Store is the package index behind the HTTP handlers. Opening a SQL store
+// fails unless its schema is at the version of this build, see runMigrate.
+type Store interface {
+	// Package returns a package with its dependencies and features
+	Package(name string) (Package, error)
+	PackageExists(name string) (bool, error)
+	// ListPackages returns the page selected by q with its dependencies and
+	// features, plus one extra package when another page follows, and the
+	// number of packages matching q's filters
+	ListPackages(q listQuery) ([]Package, int, error)
+	CreatePackage(pkg Package) error
+	// UpdatePackage writes the difference between the stored package and
+	// desired, read in the same transaction, and returns the package as it was
+	UpdatePackage(desired Package) (Package, error)
+	DeletePackage(name string) error
+
+	// SearchPackages returns every match of sq with its relevance, higher is better
+	SearchPackages(sq searchQuery) ([]searchHit, error)
+	// ReverseEdges returns, for every dependency, the packages depending on it
+	ReverseEdges() (map[string]map[string]*DependentEdge, error)
+
+	// PackageVersions returns the recorded versions of a package in no particular order
+	PackageVersions(name string) ([]PackageVersion, error)
+	PackageVersion(name, version string) (PackageVersion, error)
+
+	// CMakeTargets returns the mapped targets of a package and all its features
+	CMakeTargets(name string) ([]CMakeTarget, error)
+	// ReplaceCMakeTargets stores an edited target list; cmake_target follows
+	// the first target of the package itself
+	ReplaceCMakeTargets(name string, targets []CMakeTarget) error
+	// DeleteCMakeTargets drops the edited list and resets cmake_target to the
+	// package name, until ingest maps the package again
+	DeleteCMakeTargets(name string) error
+
+	Close() error
+}
+
+// store is the backend selected by DATABASE_DRIVER
+var store Store
+
+// openStore opens the backend for driver: sqlite3, postgres or memory
+func openStore(driver, url string) (Store, error) {
+	switch driver {
+	case "sqlite3":
+		return newSQLiteStore(url)
+	case "postgres":
+		return newPostgresStore(url)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q, expected sqlite3, postgres or memory", driver)
+	}
+}
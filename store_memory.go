@@ -0,0 +1,357 @@
+package main
+
+import (
+	"cmp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// memoryStore keeps the index in maps. It starts empty and forgets everything
+// on restart, which makes it a backend for tests and quick experiments.
+type memoryStore struct {
+	mu       sync.RWMutex
+	packages map[string]Package
+	versions map[string]map[string]PackageVersion
+	targets  map[string][]CMakeTarget
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		packages: make(map[string]Package),
+		versions: make(map[string]map[string]PackageVersion),
+		targets:  make(map[string][]CMakeTarget),
+	}
+}
+
+// clonePackage copies the slices and maps of pkg so callers cannot change
+// what the store holds
+func clonePackage(pkg Package) Package {
+	pkg.Dependencies = append([]Dependency(nil), pkg.Dependencies...)
+	pkg.DefaultFeatures = append([]DefaultFeature(nil), pkg.DefaultFeatures...)
+	if pkg.Features != nil {
+		features := make(map[string]Feature, len(pkg.Features))
+		for name, feat := range pkg.Features {
+			feat.Dependencies = append([]Dependency(nil), feat.Dependencies...)
+			feat.RequiredFeatures = append([]FeatureRequirement(nil), feat.RequiredFeatures...)
+			features[name] = feat
+		}
+		pkg.Features = features
+	}
+	return pkg
+}
+
+// normalizePackage stores requirements the way the SQL stores read them back
+func normalizePackage(pkg Package) Package {
+	pkg = clonePackage(pkg)
+	if pkg.Features == nil {
+		pkg.Features = make(map[string]Feature)
+	}
+	for name, feat := range pkg.Features {
+		feat.RequiredFeatures = featureRequirements(pkg.Name, feat)
+		pkg.Features[name] = feat
+	}
+	return pkg
+}
+
+func (s *memoryStore) Package(name string) (Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pkg, ok := s.packages[name]
+	if !ok {
+		return Package{}, ErrNotFound
+	}
+	return clonePackage(pkg), nil
+}
+
+func (s *memoryStore) PackageExists(name string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.packages[name]
+	return ok, nil
+}
+
+// filter applies the conditions of listQuery.filterSQL
+func (s *memoryStore) filter(q listQuery, pkg Package) bool {
+	if q.License != "" && pkg.License != q.License {
+		return false
+	}
+	if q.MinStars > 0 && pkg.Stars < q.MinStars {
+		return false
+	}
+	if _, ok := pkg.Features[q.Feature]; q.Feature != "" && !ok {
+		return false
+	}
+	return q.matches(pkg)
+}
+
+// compareSortKey orders a and b by the sort column of q, ignoring the order
+func compareSortKey(q listQuery, a, b Package) int {
+	switch q.Sort {
+	case "stars":
+		return cmp.Compare(a.Stars, b.Stars)
+	case "last_modified":
+		return strings.Compare(a.LastModified, b.LastModified)
+	default:
+		return strings.Compare(a.Name, b.Name)
+	}
+}
+
+// before reports whether a comes before b in the order of q. Ties on the sort
+// column are broken by name, always ascending.
+func before(q listQuery, a, b Package) bool {
+	if c := compareSortKey(q, a, b); c != 0 {
+		return (c < 0) == (q.Order != "desc")
+	}
+	return a.Name < b.Name
+}
+
+func (s *memoryStore) ListPackages(q listQuery) ([]Package, int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var matching []Package
+	for _, pkg := range s.packages {
+		if s.filter(q, pkg) {
+			matching = append(matching, pkg)
+		}
+	}
+	sort.Slice(matching, func(i, j int) bool { return before(q, matching[i], matching[j]) })
+
+	var after *Package
+	if q.Cursor != nil {
+		after = &Package{Name: q.Cursor.Name, LastModified: q.Cursor.Value}
+		after.Stars, _ = strconv.Atoi(q.Cursor.Value)
+	}
+	packages := []Package{}
+	for _, pkg := range matching {
+		if after != nil && !before(q, *after, pkg) {
+			continue
+		}
+		packages = append(packages, clonePackage(pkg))
+		if len(packages) > q.Limit {
+			break
+		}
+	}
+	return packages, len(matching), nil
+}
+
+func (s *memoryStore) CreatePackage(pkg Package) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pkg = normalizePackage(pkg)
+	s.packages[pkg.Name] = pkg
+	s.recordVersion(pkg)
+	return nil
+}
+
+func (s *memoryStore) UpdatePackage(desired Package) (Package, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, ok := s.packages[desired.Name]
+	if !ok {
+		return Package{}, ErrNotFound
+	}
+	desired = normalizePackage(desired)
+	s.packages[desired.Name] = desired
+	s.recordVersion(desired)
+	return clonePackage(current), nil
+}
+
+// recordVersion is upsertVersionSnapshot for the memory store; the caller holds mu
+func (s *memoryStore) recordVersion(pkg Package) {
+	if s.versions[pkg.Name] == nil {
+		s.versions[pkg.Name] = make(map[string]PackageVersion)
+	}
+	v := s.versions[pkg.Name][pkg.Version]
+	v.Version = pkg.Version
+	v.PortVersion = pkg.PortVersion
+	v.ReleaseDate = pkg.LastModified
+	v.Dependencies = clonePackage(pkg).Dependencies
+	v.Features = versionSnapshotFeatures(clonePackage(pkg))
+	s.versions[pkg.Name][pkg.Version] = v
+}
+
+func (s *memoryStore) DeletePackage(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.packages, name)
+	delete(s.versions, name)
+	delete(s.targets, name)
+	return nil
+}
+
+// SearchPackages matches every term as a case-insensitive substring, weighting
+// the fields like the FTS5 index does
+func (s *memoryStore) SearchPackages(sq searchQuery) ([]searchHit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var hits []searchHit
+	for _, pkg := range s.packages {
+		if !searchFilter(sq, pkg) {
+			continue
+		}
+		var featureNames, featureDescriptions []string
+		for name, feat := range pkg.Features {
+			featureNames = append(featureNames, name)
+			featureDescriptions = append(featureDescriptions, feat.Description)
+		}
+		fields := []struct {
+			text   string
+			weight float64
+		}{
+			{pkg.Name, 10},
+			{pkg.Description, 4},
+			{strings.Join(featureNames, " "), 2},
+			{strings.Join(featureDescriptions, " "), 1},
+		}
+
+		relevance := 0.0
+		matched := true
+		for _, term := range sq.Terms {
+			term = strings.ToLower(strings.TrimSpace(term))
+			if term == "" {
+				continue
+			}
+			found := false
+			for _, field := range fields {
+				if strings.Contains(strings.ToLower(field.text), term) {
+					relevance += field.weight
+					found = true
+				}
+			}
+			matched = matched && found
+		}
+		if matched {
+			hits = append(hits, searchHit{Name: pkg.Name, Relevance: relevance, Stars: pkg.Stars})
+		}
+	}
+	return hits, nil
+}
+
+// searchFilter applies the field filters of searchQuery.filterSQL
+func searchFilter(sq searchQuery, pkg Package) bool {
+	for _, license := range sq.Licenses {
+		if !strings.Contains(strings.ToLower(pkg.License), strings.ToLower(license)) {
+			return false
+		}
+	}
+	for _, dep := range sq.Deps {
+		if !dependsOn(pkg, dep) {
+			return false
+		}
+	}
+	for _, feature := range sq.Features {
+		if _, ok := pkg.Features[feature]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// dependsOn reports whether pkg or one of its features depends on name
+func dependsOn(pkg Package, name string) bool {
+	for _, dep := range pkg.Dependencies {
+		if dep.Name == name {
+			return true
+		}
+	}
+	for _, feat := range pkg.Features {
+		for _, dep := range feat.Dependencies {
+			if dep.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) ReverseEdges() (map[string]map[string]*DependentEdge, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	reverse := make(map[string]map[string]*DependentEdge)
+	for _, pkg := range s.packages {
+		for _, dep := range pkg.Dependencies {
+			addReverseEdge(reverse, pkg.Name, dep.Name, "")
+		}
+	}
+
+	// Features in name order, like the SQL stores
+	type featureEdge struct{ from, feature, to string }
+	seen := make(map[featureEdge]bool)
+	var edges []featureEdge
+	for _, pkg := range s.packages {
+		for featName, feat := range pkg.Features {
+			for _, dep := range feat.Dependencies {
+				e := featureEdge{pkg.Name, featName, dep.Name}
+				if !seen[e] {
+					seen[e] = true
+					edges = append(edges, e)
+				}
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].feature < edges[j].feature })
+	for _, e := range edges {
+		addReverseEdge(reverse, e.from, e.to, e.feature)
+	}
+	return reverse, nil
+}
+
+func (s *memoryStore) PackageVersions(name string) ([]PackageVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	current := s.packages[name].Version
+	versions := []PackageVersion{}
+	for _, v := range s.versions[name] {
+		v.Latest = v.Version == current
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+func (s *memoryStore) PackageVersion(name, version string) (PackageVersion, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	v, ok := s.versions[name][version]
+	if !ok {
+		return v, ErrNotFound
+	}
+	return v, nil
+}
+
+func (s *memoryStore) CMakeTargets(name string) ([]CMakeTarget, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]CMakeTarget{}, s.targets[name]...), nil
+}
+
+func (s *memoryStore) ReplaceCMakeTargets(name string, targets []CMakeTarget) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets[name] = append([]CMakeTarget(nil), targets...)
+	if pkg, ok := s.packages[name]; ok {
+		pkg.CMakeTarget = primaryCMakeTarget(name, targets)
+		s.packages[name] = pkg
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteCMakeTargets(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.targets, name)
+	if pkg, ok := s.packages[name]; ok {
+		pkg.CMakeTarget = primaryCMakeTarget(name, nil)
+		s.packages[name] = pkg
+	}
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/frate-packages/package-server/schema"
+)
+
+// dialect holds what differs between the SQL databases a sqlStore runs on
+type dialect struct {
+	// numbered uses $1, $2 placeholders instead of ?
+	numbered bool
+	// like is the case-insensitive LIKE operator
+	like string
+	// insertOrder is a column that follows insertion order
+	insertOrder string
+	// forUpdate locks the rows a transaction reads before writing them, where
+	// beginning the transaction does not already
+	forUpdate string
+}
+
+// rebind rewrites the ? placeholders of query for the dialect. Queries never
+// contain a literal question mark, so string literals need no special care.
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// sqlConn is the part of *sql.DB and *sql.Tx the stores use
+type sqlConn interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// rebound runs queries written with ? placeholders in any dialect
+type rebound struct {
+	conn    sqlConn
+	dialect dialect
+}
+
+func (r rebound) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return r.conn.Exec(r.dialect.rebind(query), args...)
+}
+
+func (r rebound) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return r.conn.Query(r.dialect.rebind(query), args...)
+}
+
+func (r rebound) QueryRow(query string, args ...interface{}) *sql.Row {
+	return r.conn.QueryRow(r.dialect.rebind(query), args...)
+}
+
+// searchIndex maintains and queries the full-text search of a sqlStore
+type searchIndex interface {
+	refresh(conn sqlConn, name string) error
+	remove(conn sqlConn, name string) error
+	search(conn sqlConn, sq searchQuery) ([]searchHit, error)
+}
+
+// sqlStore implements Store on database/sql. The SQLite and PostgreSQL
+// backends share it and differ in dialect, schema and search.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+	index   searchIndex
+	// checkWrite, when set, vets the outcome of a transaction's writes before
+	// it commits and may turn it into ErrWriteUnavailable
+	checkWrite func(err error) error
+}
+
+func (s *sqlStore) conn() sqlConn {
+	return rebound{s.db, s.dialect}
+}
+
+// inTx runs fn in a transaction, committing when it returns nil
+func (s *sqlStore) inTx(fn func(conn sqlConn) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		if s.checkWrite != nil {
+			return s.checkWrite(err)
+		}
+		return err
+	}
+	defer tx.Rollback()
+	err = fn(rebound{tx, s.dialect})
+	if s.checkWrite != nil {
+		err = s.checkWrite(err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		if s.checkWrite != nil {
+			return s.checkWrite(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// packageColumns is the column list read by scanPackage
+const packageColumns = "name, version, COALESCE(port_version, 0), description, COALESCE(homepage, ''), git_url, COALESCE(repository_source, ''), license, supports, stars, last_modified, cmake_target"
+
+func scanPackage(scan func(dest ...interface{}) error, pkg *Package) error {
+	return scan(&pkg.Name, &pkg.Version, &pkg.PortVersion, &pkg.Description, &pkg.Homepage, &pkg.GitURL, &pkg.RepositorySource, &pkg.License, &pkg.Supports, &pkg.Stars, &pkg.LastModified, &pkg.CMakeTarget)
+}
+
+func (s *sqlStore) Package(name string) (Package, error) {
+	return readPackage(s.conn(), name, "")
+}
+
+// readPackage reads a package with its edges through conn, appending suffix
+// to the query of its row
+func readPackage(conn sqlConn, name, suffix string) (Package, error) {
+	var pkg Package
+	err := scanPackage(conn.QueryRow("SELECT "+packageColumns+" FROM packages WHERE name = ?"+suffix, name).Scan, &pkg)
+	if err == sql.ErrNoRows {
+		return pkg, ErrNotFound
+	} else if err != nil {
+		return pkg, err
+	}
+	packages := []Package{pkg}
+	err = loadPackageEdges(conn, packages)
+	return packages[0], err
+}
+
+func (s *sqlStore) PackageExists(name string) (bool, error) {
+	var exists bool
+	err := s.conn().QueryRow("SELECT EXISTS (SELECT 1 FROM packages WHERE name = ?)", name).Scan(&exists)
+	return exists, err
+}
+
+// edgeBatchSize bounds the package names bound to one edge query
+const edgeBatchSize = 500
+
+// loadPackageEdges adds the dependencies, features and default features of
+// packages, with one query per table for each batch of packages
+func loadPackageEdges(conn sqlConn, packages []Package) error {
+	for start := 0; start < len(packages); start += edgeBatchSize {
+		end := start + edgeBatchSize
+		if end > len(packages) {
+			end = len(packages)
+		}
+		if err := loadEdgeBatch(conn, packages[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadEdgeBatch(conn sqlConn, packages []Package) error {
+	byName := make(map[string]*Package, len(packages))
+	names := make([]interface{}, len(packages))
+	for i := range packages {
+		pkg := &packages[i]
+		pkg.Dependencies, pkg.Features, pkg.DefaultFeatures = nil, make(map[string]Feature), nil
+		byName[pkg.Name] = pkg
+		names[i] = pkg.Name
+	}
+	in := " WHERE package_name IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ") + ")"
+
+	// Features come first, the feature edges below are only kept for known features
+	err := queryEach(conn, "SELECT package_name, feature_name, description, COALESCE(supports, '') FROM features"+in, names, func(rows *sql.Rows) error {
+		var packageName, featureName, description, supports string
+		if err := rows.Scan(&packageName, &featureName, &description, &supports); err != nil {
+			return err
+		}
+		byName[packageName].Features[featureName] = Feature{Description: description, Supports: supports}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = queryEach(conn, "SELECT package_name, "+schema.DependencyColumns+" FROM dependencies"+in, names, func(rows *sql.Rows) error {
+		var packageName string
+		dep, err := schema.ScanDependency(rows.Scan, &packageName)
+		if err != nil {
+			return err
+		}
+		pkg := byName[packageName]
+		pkg.Dependencies = append(pkg.Dependencies, Dependency(dep))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = queryEach(conn, "SELECT package_name, feature_name, "+schema.DependencyColumns+" FROM feature_dependencies"+in, names, func(rows *sql.Rows) error {
+		var packageName, featureName string
+		dep, err := schema.ScanDependency(rows.Scan, &packageName, &featureName)
+		if err != nil {
+			return err
+		}
+		features := byName[packageName].Features
+		if feat, ok := features[featureName]; ok {
+			feat.Dependencies = append(feat.Dependencies, Dependency(dep))
+			features[featureName] = feat
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Requirements name their own package explicitly, the API leaves it empty
+	err = queryEach(conn, "SELECT package_name, feature_name, required_package, required_feature, COALESCE(platform, '') FROM feature_requirements"+in, names, func(rows *sql.Rows) error {
+		var packageName, featureName string
+		var req FeatureRequirement
+		if err := rows.Scan(&packageName, &featureName, &req.Package, &req.Feature, &req.Platform); err != nil {
+			return err
+		}
+		if req.Package == packageName {
+			req.Package = ""
+		}
+		features := byName[packageName].Features
+		if feat, ok := features[featureName]; ok {
+			feat.RequiredFeatures = append(feat.RequiredFeatures, req)
+			features[featureName] = feat
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return queryEach(conn, "SELECT package_name, feature_name, COALESCE(platform, '') FROM default_features"+in, names, func(rows *sql.Rows) error {
+		var packageName string
+		var feature DefaultFeature
+		if err := rows.Scan(&packageName, &feature.Name, &feature.Platform); err != nil {
+			return err
+		}
+		pkg := byName[packageName]
+		pkg.DefaultFeatures = append(pkg.DefaultFeatures, feature)
+		return nil
+	})
+}
+
+// queryEach runs query and calls fn for every row
+func queryEach(conn sqlConn, query string, args []interface{}, fn func(rows *sql.Rows) error) error {
+	rows, err := conn.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := fn(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) ListPackages(q listQuery) ([]Package, int, error) {
+	conn := s.conn()
+	total, err := s.countPackages(q)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pageSQL, pageArgs := q.pageSQL(s.dialect)
+	rows, err := conn.Query(pageSQL, pageArgs...)
+	if err != nil {
+		return nil, 0, err
+	}
+	packages := []Package{}
+	for rows.Next() {
+		var pkg Package
+		if err := scanPackage(rows.Scan, &pkg); err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		if !q.matches(pkg) {
+			continue
+		}
+		packages = append(packages, pkg)
+		if len(packages) > q.Limit {
+			break
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := loadPackageEdges(conn, packages); err != nil {
+		return nil, 0, err
+	}
+	return packages, total, nil
+}
+
+// countPackages returns the number of packages matching the query, ignoring the cursor
+func (s *sqlStore) countPackages(q listQuery) (int, error) {
+	where, args := q.filterSQL(s.dialect)
+	var total int
+	if q.Triplet == "" {
+		err := s.conn().QueryRow("SELECT COUNT(*) FROM packages"+where, args...).Scan(&total)
+		return total, err
+	}
+
+	rows, err := s.conn().Query("SELECT supports FROM packages"+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pkg Package
+		if err := rows.Scan(&pkg.Supports); err != nil {
+			return 0, err
+		}
+		if q.matches(pkg) {
+			total++
+		}
+	}
+	return total, rows.Err()
+}
+
+func (s *sqlStore) CreatePackage(pkg Package) error {
+	return s.inTx(func(conn sqlConn) error {
+		_, err := conn.Exec(`INSERT INTO packages (name, version, port_version, description, homepage, git_url, repository_source, license, supports, stars, last_modified, cmake_target, source)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 'api')`,
+			pkg.Name, pkg.Version, pkg.PortVersion, pkg.Description, pkg.Homepage, pkg.GitURL, pkg.RepositorySource, pkg.License, pkg.Supports, pkg.Stars, pkg.LastModified, pkg.CMakeTarget)
+		if err != nil {
+			return err
+		}
+		for _, dep := range pkg.Dependencies {
+			if err := insertDependency(conn, pkg.Name, dep); err != nil {
+				return err
+			}
+		}
+		for featName, feat := range pkg.Features {
+			if err := insertFeature(conn, pkg.Name, featName, feat); err != nil {
+				return err
+			}
+		}
+		for _, feature := range pkg.DefaultFeatures {
+			if err := insertDefaultFeature(conn, pkg.Name, feature); err != nil {
+				return err
+			}
+		}
+		if err := upsertVersionSnapshot(conn, pkg); err != nil {
+			return err
+		}
+		return s.index.refresh(conn, pkg.Name)
+	})
+}
+
+func insertDependency(conn sqlConn, packageName string, dep Dependency) error {
+	_, err := conn.Exec("INSERT INTO dependencies (package_name, dependency_name, platform, host, features, default_features) VALUES (?, ?, ?, ?, ?, ?)",
+		append([]interface{}{packageName}, schema.Dependency(dep).Values()...)...)
+	return err
+}
+
+func insertFeatureDependency(conn sqlConn, packageName, featName string, dep Dependency) error {
+	_, err := conn.Exec("INSERT INTO feature_dependencies (package_name, feature_name, dependency_name, platform, host, features, default_features) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		append([]interface{}{packageName, featName}, schema.Dependency(dep).Values()...)...)
+	return err
+}
+
+func insertFeatureRequirement(conn sqlConn, packageName, featName string, req FeatureRequirement) error {
+	_, err := conn.Exec("INSERT INTO feature_requirements (package_name, feature_name, required_package, required_feature, platform) VALUES (?, ?, ?, ?, ?)",
+		schema.FeatureRequirement(req).Values(packageName, featName)...)
+	return err
+}
+
+func insertDefaultFeature(conn sqlConn, packageName string, feature DefaultFeature) error {
+	_, err := conn.Exec("INSERT INTO default_features (package_name, feature_name, platform) VALUES (?, ?, ?)", packageName, feature.Name, feature.Platform)
+	return err
+}
+
+// edges converts the rows of pkg outside of packages for schema.UpdateEdges
+func (pkg Package) edges() schema.Edges {
+	edges := schema.Edges{Features: make(map[string]schema.Feature, len(pkg.Features))}
+	for _, dep := range pkg.Dependencies {
+		edges.Dependencies = append(edges.Dependencies, schema.Dependency(dep))
+	}
+	for _, feature := range pkg.DefaultFeatures {
+		edges.DefaultFeatures = append(edges.DefaultFeatures, schema.DefaultFeature(feature))
+	}
+	for name, feat := range pkg.Features {
+		stored := schema.Feature{Description: feat.Description, Supports: feat.Supports}
+		for _, dep := range feat.Dependencies {
+			stored.Dependencies = append(stored.Dependencies, schema.Dependency(dep))
+		}
+		for _, req := range feat.RequiredFeatures {
+			stored.RequiredFeatures = append(stored.RequiredFeatures, schema.FeatureRequirement(req))
+		}
+		edges.Features[name] = stored
+	}
+	return edges
+}
+
+// insertFeature writes a feature with its dependencies and requirements
+func insertFeature(conn sqlConn, packageName, featName string, feat Feature) error {
+	if _, err := conn.Exec("INSERT INTO features (package_name, feature_name, description, supports) VALUES (?, ?, ?, ?)", packageName, featName, feat.Description, feat.Supports); err != nil {
+		return err
+	}
+	for _, dep := range feat.Dependencies {
+		if err := insertFeatureDependency(conn, packageName, featName, dep); err != nil {
+			return err
+		}
+	}
+	for _, req := range featureRequirements(packageName, feat) {
+		if err := insertFeatureRequirement(conn, packageName, featName, req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) UpdatePackage(desired Package) (Package, error) {
+	var current Package
+	err := s.inTx(func(conn sqlConn) error {
+		// Diff against the stored package, locked until commit, so concurrent
+		// updates cannot both add the same edges
+		var err error
+		if current, err = readPackage(conn, desired.Name, s.dialect.forUpdate); err != nil {
+			return err
+		}
+
+		// source marks the package as edited, so ingest does not revert it
+		_, err = conn.Exec(`UPDATE packages SET version = ?, port_version = ?, description = ?, homepage = ?, git_url = ?, repository_source = ?, license = ?, supports = ?, stars = ?, last_modified = ?, cmake_target = ?, source = 'api'
+			WHERE name = ?`,
+			desired.Version, desired.PortVersion, desired.Description, desired.Homepage, desired.GitURL, desired.RepositorySource, desired.License, desired.Supports, desired.Stars, desired.LastModified, desired.CMakeTarget, desired.Name)
+		if err != nil {
+			return err
+		}
+
+		// Requirements are stored with those the dependencies of a feature turn on
+		stored := desired
+		stored.Features = versionSnapshotFeatures(desired)
+		if err := schema.UpdateEdges(conn, desired.Name, current.edges(), stored.edges()); err != nil {
+			return err
+		}
+
+		// Keep the snapshot of the (possibly new) current version in sync
+		if err := upsertVersionSnapshot(conn, desired); err != nil {
+			return err
+		}
+		return s.index.refresh(conn, desired.Name)
+	})
+	return current, err
+}
+
+// packageTables are the tables holding rows of a package, besides packages itself
+var packageTables = []string{"dependencies", "features", "feature_dependencies", "feature_requirements", "default_features", "cmake_targets", "package_versions"}
+
+func (s *sqlStore) DeletePackage(name string) error {
+	return s.inTx(func(conn sqlConn) error {
+		for _, table := range packageTables {
+			if _, err := conn.Exec("DELETE FROM "+table+" WHERE package_name = ?", name); err != nil {
+				return err
+			}
+		}
+		if _, err := conn.Exec("DELETE FROM packages WHERE name = ?", name); err != nil {
+			return err
+		}
+		return s.index.remove(conn, name)
+	})
+}
+
+func (s *sqlStore) SearchPackages(sq searchQuery) ([]searchHit, error) {
+	return s.index.search(s.conn(), sq)
+}
+
+func (s *sqlStore) ReverseEdges() (map[string]map[string]*DependentEdge, error) {
+	reverse := make(map[string]map[string]*DependentEdge)
+	err := queryEach(s.conn(), "SELECT DISTINCT package_name, dependency_name FROM dependencies", nil, func(rows *sql.Rows) error {
+		var from, to string
+		if err := rows.Scan(&from, &to); err != nil {
+			return err
+		}
+		addReverseEdge(reverse, from, to, "")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = queryEach(s.conn(), "SELECT DISTINCT package_name, feature_name, dependency_name FROM feature_dependencies ORDER BY feature_name", nil, func(rows *sql.Rows) error {
+		var from, feature, to string
+		if err := rows.Scan(&from, &feature, &to); err != nil {
+			return err
+		}
+		addReverseEdge(reverse, from, to, feature)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reverse, nil
+}
+
+// upsertVersionSnapshot records pkg.Version with the current dependency and feature set
+func upsertVersionSnapshot(conn sqlConn, pkg Package) error {
+	dependencies, err := json.Marshal(pkg.Dependencies)
+	if err != nil {
+		return err
+	}
+	features, err := json.Marshal(versionSnapshotFeatures(pkg))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(`INSERT INTO package_versions (package_name, version, port_version, tag, release_date, dependencies, features)
+		VALUES (?, ?, ?, '', ?, ?, ?)
+		ON CONFLICT(package_name, version) DO UPDATE SET
+			port_version = excluded.port_version, release_date = excluded.release_date,
+			dependencies = excluded.dependencies, features = excluded.features`,
+		pkg.Name, pkg.Version, pkg.PortVersion, pkg.LastModified, string(dependencies), string(features))
+	return err
+}
+
+const packageVersionColumns = "version, COALESCE(port_version, 0), COALESCE(tag, ''), COALESCE(ref_type, ''), COALESCE(object_sha, ''), COALESCE(commit_sha, ''), COALESCE(release_date, ''), dependencies, features"
+
+// scanPackageVersion decodes a package_versions row into v
+func scanPackageVersion(scan func(dest ...interface{}) error, v *PackageVersion) error {
+	var dependencies, features sql.NullString
+	if err := scan(&v.Version, &v.PortVersion, &v.Tag, &v.RefType, &v.Object, &v.Commit, &v.ReleaseDate, &dependencies, &features); err != nil {
+		return err
+	}
+	v.ManifestUnknown = !dependencies.Valid
+	if dependencies.Valid && dependencies.String != "" {
+		if err := json.Unmarshal([]byte(dependencies.String), &v.Dependencies); err != nil {
+			return err
+		}
+	}
+	if features.Valid && features.String != "" {
+		if err := json.Unmarshal([]byte(features.String), &v.Features); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlStore) PackageVersions(name string) ([]PackageVersion, error) {
+	// Without a package row no version is the latest
+	var current string
+	err := s.conn().QueryRow("SELECT COALESCE(version, '') FROM packages WHERE name = ?", name).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := s.conn().Query("SELECT "+packageVersionColumns+" FROM package_versions WHERE package_name = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []PackageVersion{}
+	for rows.Next() {
+		var v PackageVersion
+		if err := scanPackageVersion(rows.Scan, &v); err != nil {
+			return nil, err
+		}
+		v.Latest = v.Version == current
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func (s *sqlStore) PackageVersion(name, version string) (PackageVersion, error) {
+	var v PackageVersion
+	row := s.conn().QueryRow("SELECT "+packageVersionColumns+" FROM package_versions WHERE package_name = ? AND version = ?", name, version)
+	err := scanPackageVersion(row.Scan, &v)
+	if err == sql.ErrNoRows {
+		return v, ErrNotFound
+	}
+	return v, err
+}
+
+func (s *sqlStore) CMakeTargets(name string) ([]CMakeTarget, error) {
+	rows, err := s.conn().Query("SELECT COALESCE(feature_name, ''), find_package, COALESCE(component, ''), target, COALESCE(module, 0) FROM cmake_targets WHERE package_name = ? ORDER BY "+s.dialect.insertOrder, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	targets := []CMakeTarget{}
+	for rows.Next() {
+		var t CMakeTarget
+		if err := rows.Scan(&t.Feature, &t.FindPackage, &t.Component, &t.Target, &t.Module); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	return targets, rows.Err()
+}
+
+func (s *sqlStore) ReplaceCMakeTargets(name string, targets []CMakeTarget) error {
+	return s.inTx(func(conn sqlConn) error {
+		if _, err := conn.Exec("DELETE FROM cmake_targets WHERE package_name = ?", name); err != nil {
+			return err
+		}
+		for _, t := range targets {
+			_, err := conn.Exec("INSERT INTO cmake_targets (package_name, feature_name, find_package, component, target, module, source) VALUES (?, ?, ?, ?, ?, ?, 'admin')",
+				name, t.Feature, t.FindPackage, t.Component, t.Target, boolInt(t.Module))
+			if err != nil {
+				return err
+			}
+		}
+		_, err := conn.Exec("UPDATE packages SET cmake_target = ? WHERE name = ?", primaryCMakeTarget(name, targets), name)
+		return err
+	})
+}
+
+func (s *sqlStore) DeleteCMakeTargets(name string) error {
+	return s.inTx(func(conn sqlConn) error {
+		if _, err := conn.Exec("DELETE FROM cmake_targets WHERE package_name = ?", name); err != nil {
+			return err
+		}
+		_, err := conn.Exec("UPDATE packages SET cmake_target = ? WHERE name = ?", primaryCMakeTarget(name, nil), name)
+		return err
+	})
+}
+
+// boolInt stores a flag as 0 or 1, the integer columns work in every dialect
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
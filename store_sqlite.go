@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/frate-packages/package-server/schema"
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteDialect relies on LIKE being case-insensitive and on the implicit
+// rowid. Transactions begin with the write lock, see newSQLiteStore.
+var sqliteDialect = dialect{like: "LIKE", insertOrder: "rowid"}
+
+// newSQLiteStore opens the SQLite database at path once its schema is current
+func newSQLiteStore(path string) (Store, error) {
+	opened, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	// BEGIN IMMEDIATE takes the write lock up front, so a transaction that
+	// reads before writing is never turned away when upgrading its lock
+	db, err := sql.Open("sqlite3", path+"?_txlock=immediate")
+	if err == nil {
+		err = db.Ping()
+	}
+	if err == nil {
+		err = schema.SQLite.Check(db)
+	}
+	if err != nil {
+		if db != nil {
+			db.Close()
+		}
+		return nil, err
+	}
+	return &sqlStore{
+		db:         db,
+		dialect:    sqliteDialect,
+		index:      newSQLiteSearch(db),
+		checkWrite: snapshotWriteCheck(path, opened),
+	}, nil
+}
+
+// snapshotWriteCheck guards writes against an ingest swapping in a new
+// snapshot. Ingest holds the write lock of the live file from the moment it
+// copies it until it has renamed the new one over it, so a write either
+// commits before the copy, waits on the lock and times out, or gets the lock
+// once the file it would commit to is no longer at path. The last two would
+// be lost, and fail with ErrWriteUnavailable instead.
+func snapshotWriteCheck(path string, opened os.FileInfo) func(err error) error {
+	return func(err error) error {
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+			return ErrWriteUnavailable
+		}
+		// A moved database also fails writes with SQLITE_READONLY_DBMOVED
+		if current, statErr := os.Stat(path); statErr != nil || !os.SameFile(opened, current) {
+			return ErrWriteUnavailable
+		}
+		return err
+	}
+}
+
+// Column weights for bm25(), in the column order of packages_fts
+const searchWeights = "10.0, 4.0, 2.0, 1.0"
+
+// sqliteSearch is the FTS5 index of a SQLite store. Without FTS5 the store
+// still serves everything but search.
+type sqliteSearch struct {
+	ready bool
+}
+
+// newSQLiteSearch checks that packages_fts, created by the schema
+// migrations, can be read by this build
+func newSQLiteSearch(db *sql.DB) *sqliteSearch {
+	var name string
+	err := db.QueryRow("SELECT name FROM packages_fts LIMIT 1").Scan(&name)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Search index unavailable (is SQLite built with FTS5?): %v", err)
+		return &sqliteSearch{}
+	}
+	return &sqliteSearch{ready: true}
+}
+
+// refresh rewrites the search document of a single package
+func (idx *sqliteSearch) refresh(conn sqlConn, name string) error {
+	if !idx.ready {
+		return nil
+	}
+	if err := idx.remove(conn, name); err != nil {
+		return err
+	}
+	_, err := conn.Exec(schema.InsertSearchDocuments+" WHERE p.name = ?", name)
+	return err
+}
+
+func (idx *sqliteSearch) remove(conn sqlConn, name string) error {
+	if !idx.ready {
+		return nil
+	}
+	_, err := conn.Exec("DELETE FROM packages_fts WHERE name = ?", name)
+	return err
+}
+
+func (idx *sqliteSearch) search(conn sqlConn, sq searchQuery) ([]searchHit, error) {
+	if !idx.ready {
+		return nil, ErrSearchUnavailable
+	}
+	match := sq.matchExpression()
+	filter, args := sq.filterSQL(sqliteDialect)
+
+	var query string
+	if match != "" {
+		query = "SELECT p.name, -bm25(packages_fts, " + searchWeights + "), COALESCE(p.stars, 0) FROM packages_fts JOIN packages p ON p.name = packages_fts.name WHERE packages_fts MATCH ?"
+		args = append([]interface{}{match}, args...)
+		if filter != "" {
+			query += " AND " + filter
+		}
+	} else {
+		query = "SELECT p.name, 0, COALESCE(p.stars, 0) FROM packages p"
+		if filter != "" {
+			query += " WHERE " + filter
+		}
+	}
+	return scanSearchHits(conn.Query(query, args...))
+}
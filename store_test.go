@@ -0,0 +1,468 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/frate-packages/package-server/schema"
+)
+
+// forEachStore runs the store contract against every backend this build can
+// open. The SQLite store needs FTS5: go test -tags sqlite_fts5, or it is
+// skipped. The PostgreSQL store runs when TEST_POSTGRES_URL is set.
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, newMemoryStore())
+	})
+	t.Run("sqlite3", func(t *testing.T) {
+		s, err := newSQLiteStore(migratedSQLite(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		test(t, s)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		s, err := newPostgresStore(migratedPostgres(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		test(t, s)
+	})
+}
+
+// migratedSQLite returns the path of a new SQLite file at the latest schema
+func migratedSQLite(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data.sql")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = schema.SQLite.Up(db, 0)
+	db.Close()
+	if err != nil {
+		t.Skipf("migrating SQLite: %v", err)
+	}
+	return path
+}
+
+// migratedPostgres empties the database at TEST_POSTGRES_URL with the migrate
+// command, migrates it up again and returns its URL. The database is only for
+// tests, every table in it is dropped.
+func migratedPostgres(t *testing.T) string {
+	t.Helper()
+	dbURL := os.Getenv("TEST_POSTGRES_URL")
+	if dbURL == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+	previousDriver, previousURL := databaseDriver, databaseURL
+	databaseDriver, databaseURL = "postgres", dbURL
+	t.Cleanup(func() { databaseDriver, databaseURL = previousDriver, previousURL })
+
+	if code := runMigrate([]string{"down", "0"}); code != 0 {
+		t.Fatalf("migrate down 0 exited with %d", code)
+	}
+	if code := runMigrate(nil); code != 0 {
+		t.Fatalf("migrate up exited with %d", code)
+	}
+	return dbURL
+}
+
+func createPackages(t *testing.T, s Store, packages ...Package) {
+	t.Helper()
+	for _, pkg := range packages {
+		if err := s.CreatePackage(pkg); err != nil {
+			t.Fatalf("creating %s: %v", pkg.Name, err)
+		}
+	}
+}
+
+// canonical renders pkg the way a store keeps it, with its edges sorted, so
+// backends returning them in another order, or nil instead of empty, compare equal
+func canonical(pkg Package) string {
+	type feature struct {
+		Description  string
+		Supports     string
+		Dependencies []string
+		Requirements []string
+	}
+	dependencyKeys := func(deps []Dependency) []string {
+		keys := []string{}
+		for _, dep := range deps {
+			keys = append(keys, strings.ReplaceAll(dep.key(), "\x00", " "))
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	defaults := []string{}
+	for _, feat := range pkg.DefaultFeatures {
+		defaults = append(defaults, feat.Name+" "+feat.Platform)
+	}
+	sort.Strings(defaults)
+	features := make(map[string]feature)
+	for name, feat := range pkg.Features {
+		requirements := []string{}
+		// Stored requirements include those of the feature's dependencies
+		for _, req := range featureRequirements(pkg.Name, feat) {
+			requirements = append(requirements, req.Package+"["+req.Feature+"] "+req.Platform)
+		}
+		sort.Strings(requirements)
+		features[name] = feature{feat.Description, feat.Supports, dependencyKeys(feat.Dependencies), requirements}
+	}
+
+	scalars := pkg
+	scalars.Dependencies, scalars.DefaultFeatures, scalars.Features = nil, nil, nil
+	out, _ := json.MarshalIndent(struct {
+		Package         Package
+		Dependencies    []string
+		DefaultFeatures []string
+		Features        map[string]feature
+	}{scalars, dependencyKeys(pkg.Dependencies), defaults, features}, "", "  ")
+	return string(out)
+}
+
+func names(packages []Package) []string {
+	names := []string{}
+	for _, pkg := range packages {
+		names = append(names, pkg.Name)
+	}
+	return names
+}
+
+var listFixture = []Package{
+	{Name: "a", Version: "1", License: "MIT", Stars: 5, LastModified: "2024-01-03", Features: map[string]Feature{"ssl": {Description: "ssl"}}},
+	{Name: "b", Version: "1", License: "BSD", Stars: 10, LastModified: "2024-01-01"},
+	{Name: "c", Version: "1", License: "MIT", Stars: 5, LastModified: "2024-01-02"},
+	{Name: "d", Version: "1", License: "MIT", Supports: "windows", LastModified: "2024-01-04", Features: map[string]Feature{"ssl": {Description: "ssl"}}},
+	{Name: "e", Version: "1", License: "Apache-2.0", Stars: 10, LastModified: "2024-01-05"},
+}
+
+func TestStoreListPackagesPaging(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"a", "b", "c", "d", "e"}},
+		{"order=desc", []string{"e", "d", "c", "b", "a"}},
+		// Ties on the sort column are broken by name, ascending
+		{"sort=stars", []string{"b", "e", "a", "c", "d"}},
+		{"sort=stars&order=asc", []string{"d", "a", "c", "b", "e"}},
+		{"sort=last_modified", []string{"e", "d", "a", "c", "b"}},
+		{"sort=last_modified&order=asc", []string{"b", "c", "a", "d", "e"}},
+		{"sort=stars&license=MIT", []string{"a", "c", "d"}},
+	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		createPackages(t, s, listFixture...)
+		for _, tt := range tests {
+			for _, limit := range []string{"1", "2", "5"} {
+				values, _ := url.ParseQuery(tt.query)
+				values.Set("limit", limit)
+				q, err := parseListQuery(values)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Walk the pages like listPackages does
+				var got []string
+				for pages := 0; pages <= len(listFixture); pages++ {
+					packages, total, err := s.ListPackages(q)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if total != len(tt.want) {
+						t.Errorf("%s limit %s: total %d, want %d", tt.query, limit, total, len(tt.want))
+					}
+					more := len(packages) > q.Limit
+					if more {
+						if len(packages) != q.Limit+1 {
+							t.Fatalf("%s limit %s: page of %d packages", tt.query, limit, len(packages))
+						}
+						packages = packages[:q.Limit]
+					}
+					got = append(got, names(packages)...)
+					if !more {
+						break
+					}
+					cursor := q.cursorFor(packages[len(packages)-1])
+					q.Cursor = &cursor
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s limit %s: pages %v, want %v", tt.query, limit, got, tt.want)
+				}
+			}
+		}
+	})
+}
+
+func TestStoreListPackagesFilters(t *testing.T) {
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"license=MIT", []string{"a", "c", "d"}},
+		{"min_stars=5", []string{"a", "b", "c", "e"}},
+		{"feature=ssl", []string{"a", "d"}},
+		{"triplet=x64-linux", []string{"a", "b", "c", "e"}},
+		{"triplet=x64-windows", []string{"a", "b", "c", "d", "e"}},
+		{"license=MIT&min_stars=1", []string{"a", "c"}},
+		{"license=GPL", []string{}},
+	}
+	if _, err := parseListQuery(url.Values{"supports": {"windows"}}); err == nil {
+		t.Error("supports was accepted as a filter")
+	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		createPackages(t, s, listFixture...)
+		for _, tt := range tests {
+			values, _ := url.ParseQuery(tt.query)
+			q, err := parseListQuery(values)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packages, total, err := s.ListPackages(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(packages); !reflect.DeepEqual(got, tt.want) || total != len(tt.want) {
+				t.Errorf("%s: %v of %d, want %v", tt.query, got, total, tt.want)
+			}
+		}
+	})
+}
+
+func TestStoreUpdatePackage(t *testing.T) {
+	no := false
+	curl := Package{
+		Name:            "curl",
+		Version:         "8.0.0",
+		Description:     "transfers data",
+		License:         "curl",
+		LastModified:    "2024-01-01",
+		Dependencies:    []Dependency{{Name: "zlib"}, {Name: "openssl", Platform: "!windows", Features: []string{"tools"}}},
+		DefaultFeatures: []DefaultFeature{{Name: "ssl"}, {Name: "http2", Platform: "linux"}},
+		Features: map[string]Feature{
+			"ssl": {
+				Description:      "SSL support",
+				Dependencies:     []Dependency{{Name: "openssl"}},
+				RequiredFeatures: []FeatureRequirement{{Feature: "http2"}},
+			},
+			"http2": {Description: "HTTP/2 support", Dependencies: []Dependency{{Name: "nghttp2", DefaultFeatures: &no}}},
+		},
+	}
+
+	// Every kind of edge is kept, changed, added and dropped
+	desired := curl
+	desired.Version = "8.1.0"
+	desired.Stars = 3
+	desired.Dependencies = []Dependency{{Name: "zlib"}, {Name: "openssl", Platform: "!windows", Features: []string{"tools", "ssl"}}, {Name: "brotli", Host: true}}
+	desired.DefaultFeatures = []DefaultFeature{{Name: "http2", Platform: "linux"}, {Name: "brotli"}}
+	desired.Features = map[string]Feature{
+		"ssl": {
+			Description:      "TLS support",
+			Supports:         "!uwp",
+			Dependencies:     []Dependency{{Name: "openssl", Features: []string{"tools"}}},
+			RequiredFeatures: []FeatureRequirement{{Package: "openssl", Feature: "tools", Platform: "windows"}},
+		},
+		"http2":  {Description: "HTTP/2 support", Dependencies: []Dependency{{Name: "nghttp2"}}},
+		"brotli": {Description: "brotli support", RequiredFeatures: []FeatureRequirement{{Feature: "http2"}}},
+	}
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		createPackages(t, s, curl)
+		current, err := s.Package("curl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canonical(current) != canonical(curl) {
+			t.Fatalf("created\n%s\nwant\n%s", canonical(current), canonical(curl))
+		}
+
+		previous, err := s.UpdatePackage(desired)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canonical(previous) != canonical(curl) {
+			t.Errorf("update returned\n%s\nwant\n%s", canonical(previous), canonical(curl))
+		}
+		updated, err := s.Package("curl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canonical(updated) != canonical(desired) {
+			t.Errorf("updated\n%s\nwant\n%s", canonical(updated), canonical(desired))
+		}
+
+		// Updating to what is stored changes nothing
+		if _, err := s.UpdatePackage(desired); err != nil {
+			t.Fatal(err)
+		}
+		if again, _ := s.Package("curl"); canonical(again) != canonical(desired) {
+			t.Errorf("updated twice\n%s\nwant\n%s", canonical(again), canonical(desired))
+		}
+	})
+}
+
+func TestStoreConcurrentUpdates(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		createPackages(t, s, Package{Name: "curl", Version: "8.0.0", Dependencies: []Dependency{{Name: "zlib"}}})
+		if _, err := s.UpdatePackage(Package{Name: "wget", Version: "1.0"}); err != ErrNotFound {
+			t.Errorf("updating an unknown package: %v, want ErrNotFound", err)
+		}
+
+		// Every update adds the same edges to the same old state
+		desired := Package{Name: "curl", Version: "8.1.0", Dependencies: []Dependency{{Name: "zlib"}, {Name: "openssl"}},
+			Features: map[string]Feature{"ssl": {Description: "SSL support", Dependencies: []Dependency{{Name: "openssl", Features: []string{"tools"}}}}}}
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.UpdatePackage(desired)
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		updated, err := s.Package("curl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if canonical(updated) != canonical(desired) {
+			t.Errorf("after concurrent updates\n%s\nwant\n%s", canonical(updated), canonical(desired))
+		}
+		if n := len(updated.Dependencies) + len(updated.Features["ssl"].Dependencies); n != 3 {
+			t.Errorf("%d dependency rows, want 3", n)
+		}
+	})
+}
+
+func TestStoreDeletePackage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		createPackages(t, s, listFixture...)
+		if err := s.DeletePackage("c"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Package("c"); err != ErrNotFound {
+			t.Errorf("deleted package: %v, want ErrNotFound", err)
+		}
+		if exists, _ := s.PackageExists("c"); exists {
+			t.Error("deleted package still exists")
+		}
+		if exists, _ := s.PackageExists("a"); !exists {
+			t.Error("other package gone")
+		}
+	})
+}
+
+func TestStorePackageVersions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		v1 := Package{Name: "curl", Version: "8.0.0", LastModified: "2024-01-01", Dependencies: []Dependency{{Name: "zlib"}}}
+		createPackages(t, s, v1)
+		v2 := v1
+		v2.Version = "8.1.0"
+		v2.LastModified = "2024-02-01"
+		v2.Dependencies = []Dependency{{Name: "zlib"}, {Name: "openssl"}}
+		v2.Features = map[string]Feature{"ssl": {Description: "SSL support"}}
+		if _, err := s.UpdatePackage(v2); err != nil {
+			t.Fatal(err)
+		}
+
+		versions, err := s.PackageVersions("curl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		latest := map[string]bool{}
+		for _, v := range versions {
+			latest[v.Version] = v.Latest
+		}
+		if want := map[string]bool{"8.0.0": false, "8.1.0": true}; !reflect.DeepEqual(latest, want) {
+			t.Errorf("versions %v, want %v", latest, want)
+		}
+
+		// A version keeps the edges it was recorded with
+		old, err := s.PackageVersion("curl", "8.0.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(old.Dependencies) != 1 || old.Dependencies[0].Name != "zlib" || len(old.Features) != 0 {
+			t.Errorf("8.0.0 recorded %+v", old)
+		}
+		current, err := s.PackageVersion("curl", "8.1.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if current.ReleaseDate != "2024-02-01" || len(current.Dependencies) != 2 || len(current.Features) != 1 {
+			t.Errorf("8.1.0 recorded %+v", current)
+		}
+
+		if _, err := s.PackageVersion("curl", "7.0.0"); err != ErrNotFound {
+			t.Errorf("unknown version: %v, want ErrNotFound", err)
+		}
+		if versions, err := s.PackageVersions("wget"); err != nil || len(versions) != 0 {
+			t.Errorf("versions of an unknown package: %v, %v", versions, err)
+		}
+	})
+}
+
+func TestStoreCMakeTargets(t *testing.T) {
+	targets := []CMakeTarget{
+		{Feature: "ssl", FindPackage: "OpenSSL", Target: "OpenSSL::SSL", Module: true},
+		{FindPackage: "CURL", Target: "CURL::libcurl"},
+		{FindPackage: "CURL", Component: "tools", Target: "CURL::curl"},
+	}
+	forEachStore(t, func(t *testing.T, s Store) {
+		createPackages(t, s, Package{Name: "curl", Version: "8.0.0"})
+
+		if err := s.ReplaceCMakeTargets("curl", targets); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.CMakeTargets("curl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, targets) {
+			t.Errorf("targets %+v, want %+v in the edited order", got, targets)
+		}
+		if pkg, _ := s.Package("curl"); pkg.CMakeTarget != "CURL::libcurl" {
+			t.Errorf("cmake_target %q, want the first target of the package itself", pkg.CMakeTarget)
+		}
+
+		// Without a target of its own, cmake_target falls back to the name
+		if err := s.ReplaceCMakeTargets("curl", targets[:1]); err != nil {
+			t.Fatal(err)
+		}
+		if pkg, _ := s.Package("curl"); pkg.CMakeTarget != "curl" {
+			t.Errorf("cmake_target %q, want curl", pkg.CMakeTarget)
+		}
+
+		if err := s.ReplaceCMakeTargets("curl", targets); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteCMakeTargets("curl"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.CMakeTargets("curl"); err != nil || len(got) != 0 {
+			t.Errorf("targets after delete: %+v, %v", got, err)
+		}
+		if pkg, _ := s.Package("curl"); pkg.CMakeTarget != "curl" {
+			t.Errorf("cmake_target %q after delete, want curl", pkg.CMakeTarget)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// packagePatch is the body of PATCH /packages/{name}. Absent fields are left
+// unchanged; in Features a null value removes the feature.
+type packagePatch struct {
+	Version         *string             `json:"version"`
+	PortVersion     *int                `json:"port_version"`
+	Description     *string             `json:"description"`
+	Homepage        *string             `json:"homepage"`
+	GitURL          *string             `json:"git_url"`
+	License         *string             `json:"license"`
+	Supports        *string             `json:"supports"`
+	Stars           *int                `json:"stars"`
+	CMakeTarget     *string             `json:"cmake_target"`
+	Dependencies    *[]Dependency       `json:"dependencies"`
+	Features        map[string]*Feature `json:"features"`
+	DefaultFeatures *[]DefaultFeature   `json:"default_features"`
+}
+
+// apply returns a copy of pkg with the patch applied
+func (p packagePatch) apply(pkg Package) Package {
+	if p.Version != nil {
+		pkg.Version = *p.Version
+	}
+	if p.PortVersion != nil {
+		pkg.PortVersion = *p.PortVersion
+	}
+	if p.Description != nil {
+		pkg.Description = *p.Description
+	}
+	if p.Homepage != nil {
+		pkg.Homepage = *p.Homepage
+	}
+	if p.GitURL != nil {
+		pkg.GitURL = *p.GitURL
+		pkg.RepositorySource = repositoryFromAPI
+	}
+	if p.License != nil {
+		pkg.License = *p.License
+	}
+	if p.Supports != nil {
+		pkg.Supports = *p.Supports
+	}
+	if p.Stars != nil {
+		pkg.Stars = *p.Stars
+	}
+	if p.CMakeTarget != nil {
+		pkg.CMakeTarget = *p.CMakeTarget
+	}
+	if p.Dependencies != nil {
+		pkg.Dependencies = *p.Dependencies
+	}
+	if p.DefaultFeatures != nil {
+		pkg.DefaultFeatures = *p.DefaultFeatures
+	}
+	if p.Features != nil {
+		features := make(map[string]Feature, len(pkg.Features))
+		for name, feat := range pkg.Features {
+			features[name] = feat
+		}
+		for name, feat := range p.Features {
+			if feat == nil {
+				delete(features, name)
+			} else {
+				features[name] = *feat
+			}
+		}
+		pkg.Features = features
+	}
+	return pkg
+}
+
+// updatePackage handles PUT (full replace) and PATCH (partial update) of /packages/{name}
+func updatePackage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		w.Header().Set("Allow", "PUT, PATCH")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	packageName := r.PathValue("name")
+
+	current, err := store.Package(packageName)
+	if err == ErrNotFound {
+		http.Error(w, "Package not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	var desired Package
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&desired); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if desired.Name != "" && desired.Name != packageName {
+			http.Error(w, "Package name in body does not match the URL", http.StatusBadRequest)
+			return
+		}
+		// Like create and PATCH, a git_url written through the API is marked
+		// as such; the client cannot claim another source
+		desired.RepositorySource = current.RepositorySource
+		if desired.GitURL != current.GitURL {
+			desired.RepositorySource = repositoryFromAPI
+		}
+	} else {
+		var patch packagePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		desired = patch.apply(current)
+	}
+	desired.Name = packageName
+	desired.LastModified = time.Now().UTC().String()
+
+	previous, err := store.UpdatePackage(desired)
+	if err == ErrWriteUnavailable {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err == ErrNotFound {
+		http.Error(w, "Package not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Error updating package", http.StatusInternalServerError)
+		return
+	}
+
+	// Drop what showed the package, and the list pages whose filters or
+	// sort read a column that changed
+	invalidatePackage(packageName, changedListFields(previous, desired)...)
+
+	updated, err := store.Package(packageName)
+	if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPutRepositorySource(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		// A new git_url is the API's, whatever the client claims
+		{`{"version": "1.0", "git_url": "https://example.com/zlib.git", "repository_source": "vcpkg"}`, repositoryFromAPI},
+		// An unchanged git_url keeps the source ingest found
+		{`{"version": "1.0", "git_url": "https://github.com/madler/zlib", "repository_source": "api"}`, "vcpkg"},
+	}
+	for _, tt := range tests {
+		memory := useMemoryStore(t, Package{
+			Name:             "zlib",
+			Version:          "1.0",
+			GitURL:           "https://github.com/madler/zlib",
+			RepositorySource: "vcpkg",
+		})
+
+		r := httptest.NewRequest(http.MethodPut, "/packages/zlib", strings.NewReader(tt.body))
+		r.SetPathValue("name", "zlib")
+		w := httptest.NewRecorder()
+		updatePackage(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("PUT %s: %d %s", tt.body, w.Code, w.Body)
+		}
+
+		pkg, err := memory.Package("zlib")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pkg.RepositorySource != tt.want {
+			t.Errorf("PUT %s stored repository_source %q, want %q", tt.body, pkg.RepositorySource, tt.want)
+		}
+	}
+}
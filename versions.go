@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/frate-packages/package-server/semver"
+)
+
+// PackageVersion is a single release of a package. Dependencies and features
+// are a snapshot of the manifest as it was when the version was recorded.
+// Versions discovered from git carry the ref they came from: Tag is the ref
+// name, Object the SHA it points to and Commit the commit to check out, which
+// differs from Object for annotated tags. ManifestUnknown marks tags whose
+// manifest was never ingested, so their dependencies and features are unknown.
+type PackageVersion struct {
+	Version         string             `json:"version"`
+	PortVersion     int                `json:"port_version,omitempty"`
+	Tag             string             `json:"tag"`
+	RefType         string             `json:"ref_type,omitempty"`
+	Object          string             `json:"object,omitempty"`
+	Commit          string             `json:"commit,omitempty"`
+	ReleaseDate     string             `json:"release_date,omitempty"`
+	Latest          bool               `json:"latest"`
+	ManifestUnknown bool               `json:"manifest_unknown,omitempty"`
+	Dependencies    []Dependency       `json:"dependencies,omitempty"`
+	Features        map[string]Feature `json:"features,omitempty"`
+}
+
+// PackageVersions is the response body of /package/versions
+type PackageVersions struct {
+	Name     string           `json:"name"`
+	Versions []PackageVersion `json:"versions"`
+}
+
+// versionSnapshotFeatures returns the features of pkg with requirements in the
+// same form they are stored in
+func versionSnapshotFeatures(pkg Package) map[string]Feature {
+	snapshot := make(map[string]Feature, len(pkg.Features))
+	for name, feat := range pkg.Features {
+		feat.RequiredFeatures = featureRequirements(pkg.Name, feat)
+		snapshot[name] = feat
+	}
+	return snapshot
+}
+
+func getPackageVersions(packageName string) ([]PackageVersion, error) {
+	versions, err := store.PackageVersions(packageName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest version first, then branches like master
+	sort.SliceStable(versions, func(i, j int) bool {
+		_, okI := semver.Parse(versions[i].Version)
+		_, okJ := semver.Parse(versions[j].Version)
+		if okI != okJ {
+			return okI
+		}
+		return semver.Compare(versions[i].Version, versions[j].Version) > 0
+	})
+	return versions, nil
+}
+
+// ErrManifestUnknown is returned for a version whose dependencies and
+// features were never ingested, rather than guessing them
+var ErrManifestUnknown = errors.New("the manifest of this version was never ingested, its dependencies are unknown")
+
+// fetchPackageVersion loads a package as it was at the given version.
+// It returns ErrNotFound when either the package or the version is unknown,
+// and ErrManifestUnknown when only the version's tag is known.
+func fetchPackageVersion(packageName, version string) (Package, error) {
+	pkg, err := store.Package(packageName)
+	if err != nil {
+		return pkg, err
+	}
+	v, err := store.PackageVersion(packageName, version)
+	if err != nil {
+		return pkg, err
+	}
+	if v.ManifestUnknown {
+		return pkg, ErrManifestUnknown
+	}
+
+	pkg.Version = v.Version
+	pkg.PortVersion = v.PortVersion
+	pkg.Dependencies = v.Dependencies
+	pkg.Features = v.Features
+	return pkg, nil
+}
+
+func listPackageVersions(w http.ResponseWriter, r *http.Request) {
+	packageName := r.URL.Query().Get("name")
+	if packageName == "" {
+		http.Error(w, "Missing package name", http.StatusBadRequest)
+		return
+	}
+
+	exists, err := store.PackageExists(packageName)
+	if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Package not found", http.StatusNotFound)
+		return
+	}
+
+	versions, err := getPackageVersions(packageName)
+	if err != nil {
+		http.Error(w, "Error querying database", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PackageVersions{Name: packageName, Versions: versions})
+}